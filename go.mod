@@ -1,3 +1,5 @@
 module github.com/pyke369/golang-support
 
-go 1.19
+go 1.21
+
+require github.com/mattn/go-sqlite3 v1.14.52
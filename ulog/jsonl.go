@@ -0,0 +1,115 @@
+package ulog
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JSONLOutput struct {
+	path, current string
+	keep          time.Duration
+	handle        *os.File
+	sync.Mutex
+}
+
+func init() {
+	RegisterTarget("jsonl", func(options map[string]string) Output {
+		if output := NewJSONL(options); output != nil {
+			return output
+		}
+		return nil
+	})
+}
+
+func NewJSONL(options map[string]string) *JSONLOutput {
+	if options["path"] == "" {
+		return nil
+	}
+	o := &JSONLOutput{path: options["path"], keep: 14 * 24 * time.Hour}
+	if !strings.Contains(o.path, "%") {
+		extension := filepath.Ext(o.path)
+		switch strings.ToLower(options["rotate"]) {
+		case "", "daily":
+			o.path = strings.TrimSuffix(o.path, extension) + "-%Y-%m-%d" + extension
+		case "hourly":
+			o.path = strings.TrimSuffix(o.path, extension) + "-%Y-%m-%d-%H" + extension
+		}
+	}
+	if value := strings.ToLower(options["keep"]); value != "" {
+		if strings.HasSuffix(value, "d") {
+			if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 0 {
+				o.keep = time.Duration(days) * 24 * time.Hour
+			}
+		} else if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+			o.keep = duration
+		}
+	}
+	return o
+}
+
+func (o *JSONLOutput) Write(now time.Time, severity int, message string, fields map[string]any, structured bool) error {
+	object := make(map[string]any, len(fields)+3)
+	for key, value := range fields {
+		object[key] = value
+	}
+	if _, ok := object["message"]; !ok && !structured && message != "" {
+		object["message"] = message
+	}
+	if _, ok := object["time"]; !ok {
+		object["time"] = now.Format("2006-01-02T15:04:05.000Z07:00")
+	}
+	levels(object, severity, "")
+	encoded, err := encode(object)
+	if err != nil {
+		return err
+	}
+
+	path := strftime(o.path, now)
+	o.Lock()
+	defer o.Unlock()
+	if path != o.current || o.handle == nil {
+		if o.handle != nil {
+			o.handle.Close()
+			o.handle = nil
+		}
+		os.MkdirAll(filepath.Dir(path), 0755)
+		handle, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		o.handle, o.current = handle, path
+		o.prune(now)
+	}
+	_, err = o.handle.Write(append(encoded, '\n'))
+	return err
+}
+
+func (o *JSONLOutput) Close() {
+	o.Lock()
+	if o.handle != nil {
+		o.handle.Close()
+		o.handle = nil
+	}
+	o.current = ""
+	o.Unlock()
+}
+
+func (o *JSONLOutput) prune(now time.Time) {
+	if o.keep <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(regexp.MustCompile(`%.`).ReplaceAllString(o.path, "*"))
+	for _, path := range matches {
+		if path == o.current {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && now.Sub(info.ModTime()) > o.keep {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package ulog
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lines(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry map[string]any
+
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestJSONLRotation(t *testing.T) {
+	for _, test := range []struct {
+		rotate        string
+		before, after time.Time
+		first, second string
+	}{
+		{"daily", time.Date(2026, 1, 2, 23, 59, 59, 999e6, time.UTC), time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC), "app-2026-01-02.jsonl", "app-2026-01-03.jsonl"},
+		{"hourly", time.Date(2026, 1, 2, 10, 59, 59, 999e6, time.UTC), time.Date(2026, 1, 2, 11, 0, 0, 0, time.UTC), "app-2026-01-02-10.jsonl", "app-2026-01-02-11.jsonl"},
+	} {
+		t.Run(test.rotate, func(t *testing.T) {
+			directory := t.TempDir()
+			output := NewJSONL(map[string]string{"path": filepath.Join(directory, "app.jsonl"), "rotate": test.rotate, "keep": "0d"})
+			output.Write(test.before, LOG_INFO, "before", nil, false)
+			output.Write(test.before, LOG_INFO, "before again", nil, false)
+			output.Write(test.after, LOG_WARNING, "after", nil, false)
+			output.Close()
+
+			if entries := lines(t, filepath.Join(directory, test.first)); len(entries) != 2 || entries[1]["message"] != "before again" {
+				t.Fatalf("unexpected entries in %s: %v", test.first, entries)
+			}
+			if entries := lines(t, filepath.Join(directory, test.second)); len(entries) != 1 || entries[0]["message"] != "after" || entries[0]["level"] != "warning" {
+				t.Fatalf("unexpected entries in %s: %v", test.second, entries)
+			}
+		})
+	}
+}
+
+func TestJSONLPrune(t *testing.T) {
+	directory, now := t.TempDir(), time.Now()
+	old, recent, foreign := filepath.Join(directory, "app-2020-01-01.jsonl"), filepath.Join(directory, "app-2020-01-02.jsonl"), filepath.Join(directory, "other.jsonl")
+	for _, path := range []string{old, recent, foreign} {
+		if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(old, now.Add(-72*time.Hour), now.Add(-72*time.Hour))
+	os.Chtimes(recent, now.Add(-12*time.Hour), now.Add(-12*time.Hour))
+	os.Chtimes(foreign, now.Add(-72*time.Hour), now.Add(-72*time.Hour))
+
+	output := NewJSONL(map[string]string{"path": filepath.Join(directory, "app.jsonl"), "keep": "1d"})
+	output.Write(now, LOG_INFO, "current", nil, false)
+	output.Close()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("expired partition was not pruned")
+	}
+	for _, path := range []string{recent, foreign, filepath.Join(directory, "app-"+now.Format("2006-01-02")+".jsonl")} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("%s should have been kept: %v", path, err)
+		}
+	}
+}
+
+func TestJSONLStructured(t *testing.T) {
+	directory := t.TempDir()
+	logger := New("jsonl(path=" + filepath.Join(directory, "app.jsonl") + ") option(ordered=on)")
+	logger.SetField("service", "api")
+	logger.Info(map[string]any{"event": "login", "user": 42})
+	logger.Info("plain %d", 1)
+	logger.Close()
+
+	matches, _ := filepath.Glob(filepath.Join(directory, "app-*.jsonl"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one partition, got %v", matches)
+	}
+	entries := lines(t, matches[0])
+	if len(entries) != 2 {
+		t.Fatalf("expected two entries, got %v", entries)
+	}
+	if _, ok := entries[0]["message"]; ok || entries[0]["event"] != "login" || entries[0]["service"] != "api" {
+		t.Fatalf("unexpected structured entry: %v", entries[0])
+	}
+	if entries[1]["message"] != "plain 1" || entries[1]["service"] != "api" {
+		t.Fatalf("unexpected text entry: %v", entries[1])
+	}
+}
+
+func TestJSONLErrors(t *testing.T) {
+	output := NewJSONL(map[string]string{"path": "/dev/null/ulog/app.jsonl"})
+	if err := output.Write(time.Now(), LOG_INFO, "lost", nil, false); err == nil {
+		t.Fatal("write to an unwritable partition succeeded")
+	}
+
+	logger := New("jsonl(path=/dev/null/ulog/app.jsonl)")
+	defer logger.Close()
+	dests := []string{}
+	logger.SetErrorHandler(func(dest string, _ error) {
+		dests = append(dests, dest)
+	})
+	logger.Info("lost")
+	if len(dests) != 1 || dests[0] != "jsonl" || logger.Errors()["jsonl"] != 1 {
+		t.Fatalf("unexpected error reports: %v %v", dests, logger.Errors())
+	}
+}
@@ -0,0 +1,224 @@
+package otel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/ulog"
+)
+
+var (
+	severities = map[int][2]any{
+		ulog.LOG_EMERG:   {24, "FATAL4"},
+		ulog.LOG_ALERT:   {23, "FATAL3"},
+		ulog.LOG_CRIT:    {21, "FATAL"},
+		ulog.LOG_ERR:     {17, "ERROR"},
+		ulog.LOG_WARNING: {13, "WARN"},
+		ulog.LOG_NOTICE:  {10, "INFO2"},
+		ulog.LOG_INFO:    {9, "INFO"},
+		ulog.LOG_DEBUG:   {5, "DEBUG"},
+	}
+)
+
+type Exporter struct {
+	endpoint string
+	name     string
+	size     int
+	interval time.Duration
+	client   *http.Client
+	queue    chan map[string]any
+	stop     chan struct{}
+	done     chan struct{}
+	closed   sync.Once
+}
+
+func init() {
+	ulog.RegisterTarget("otel", func(options map[string]string) ulog.Output {
+		return New(options)
+	})
+}
+
+func New(options map[string]string) *Exporter {
+	e := &Exporter{
+		endpoint: "http://localhost:4318/v1/logs",
+		name:     filepath.Base(os.Args[0]),
+		size:     512,
+		interval: time.Second,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan map[string]any, 8<<10),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if value := options["endpoint"]; value != "" {
+		e.endpoint = value
+	}
+	if value := options["name"]; value != "" {
+		e.name = value
+	}
+	if value, err := strconv.Atoi(options["batch"]); err == nil && value > 0 {
+		e.size = value
+	}
+	if value, err := time.ParseDuration(options["interval"]); err == nil && value > 0 {
+		e.interval = value
+	}
+	go e.run()
+	return e
+}
+
+func (e *Exporter) Write(now time.Time, severity int, message string, fields map[string]any, structured bool) error {
+	if value, ok := fields["message"].(string); ok && structured {
+		message, fields = value, copied(fields)
+		delete(fields, "message")
+	}
+	record := map[string]any{
+		"timeUnixNano":   strconv.FormatInt(now.UnixNano(), 10),
+		"severityNumber": severities[severity][0],
+		"severityText":   severities[severity][1],
+		"body":           map[string]any{"stringValue": message},
+	}
+	if len(fields) != 0 {
+		record["attributes"] = attributes(fields)
+	}
+	select {
+	case <-e.stop:
+	case e.queue <- record:
+	default:
+		return errors.New(`otel: export queue full`)
+	}
+	return nil
+}
+
+func (e *Exporter) Close() {
+	e.closed.Do(func() {
+		close(e.stop)
+		select {
+		case <-e.done:
+		case <-time.After(e.client.Timeout):
+		}
+	})
+}
+
+func (e *Exporter) run() {
+	records, ticker := []map[string]any{}, time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+		drain:
+			for {
+				select {
+				case record := <-e.queue:
+					records = append(records, record)
+				default:
+					break drain
+				}
+			}
+			for len(records) != 0 {
+				size := len(records)
+				if size > e.size {
+					size = e.size
+				}
+				e.send(records[:size])
+				records = records[size:]
+			}
+			close(e.done)
+			return
+		case record := <-e.queue:
+			if records = append(records, record); len(records) >= e.size {
+				e.send(records)
+				records = []map[string]any{}
+			}
+		case <-ticker.C:
+			if len(records) != 0 {
+				e.send(records)
+				records = []map[string]any{}
+			}
+		}
+	}
+}
+
+func (e *Exporter) send(records []map[string]any) {
+	if len(records) == 0 {
+		return
+	}
+	payload, err := json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": attributes(map[string]any{"service.name": e.name})},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "ulog"},
+				"logRecords": records,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	if response, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(payload)); err == nil {
+		response.Body.Close()
+	}
+}
+
+func copied(fields map[string]any) map[string]any {
+	copied := make(map[string]any, len(fields))
+	for key, value := range fields {
+		copied[key] = value
+	}
+	return copied
+}
+
+func attributes(fields map[string]any) (list []any) {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		list = append(list, map[string]any{"key": key, "value": value(fields[key])})
+	}
+	return
+}
+
+func value(input any) map[string]any {
+	switch input := input.(type) {
+	case nil:
+		return map[string]any{}
+	case string:
+		return map[string]any{"stringValue": input}
+	case bool:
+		return map[string]any{"boolValue": input}
+	case map[string]any:
+		return map[string]any{"kvlistValue": map[string]any{"values": attributes(input)}}
+	case json.RawMessage:
+		var decoded any
+
+		if json.Unmarshal(input, &decoded) == nil {
+			return value(decoded)
+		}
+		return map[string]any{"stringValue": string(input)}
+	case []any:
+		values := []any{}
+		for _, item := range input {
+			values = append(values, value(item))
+		}
+		return map[string]any{"arrayValue": map[string]any{"values": values}}
+	}
+	switch reflected := reflect.ValueOf(input); reflected.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"intValue": strconv.FormatInt(reflected.Int(), 10)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"intValue": strconv.FormatUint(reflected.Uint(), 10)}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"doubleValue": reflected.Float()}
+	}
+	return map[string]any{"stringValue": fmt.Sprintf("%v", input)}
+}
@@ -3,14 +3,19 @@ package ulog
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,6 +28,13 @@ const (
 	TIME_MSTIMESTAMP
 )
 
+// default fields never replace caller-supplied values unless another strategy is selected
+const (
+	MERGE_KEEP int = iota
+	MERGE_OVERRIDE
+	MERGE_PREFIX
+)
+
 const (
 	LOG_EMERG int = iota
 	LOG_ALERT
@@ -75,227 +87,856 @@ var (
 		"local7": LOG_LOCAL7,
 	}
 	severities = map[string]int{
-		"error":   LOG_ERR,
-		"warning": LOG_WARNING,
-		"info":    LOG_INFO,
-		"debug":   LOG_DEBUG,
+		"emerg":     LOG_EMERG,
+		"emergency": LOG_EMERG,
+		"panic":     LOG_EMERG,
+		"alert":     LOG_ALERT,
+		"crit":      LOG_CRIT,
+		"critical":  LOG_CRIT,
+		"fatal":     LOG_CRIT,
+		"error":     LOG_ERR,
+		"err":       LOG_ERR,
+		"warning":   LOG_WARNING,
+		"warn":      LOG_WARNING,
+		"notice":    LOG_NOTICE,
+		"info":      LOG_INFO,
+		"debug":     LOG_DEBUG,
+	}
+	severityNames = map[int]string{
+		LOG_EMERG:   "emerg",
+		LOG_ALERT:   "alert",
+		LOG_CRIT:    "crit",
+		LOG_ERR:     "error",
+		LOG_WARNING: "warning",
+		LOG_NOTICE:  "notice",
+		LOG_INFO:    "info",
+		LOG_DEBUG:   "debug",
 	}
 	severityLabels = map[int]string{
+		LOG_EMERG:   "EMRG ",
+		LOG_ALERT:   "ALRT ",
+		LOG_CRIT:    "CRIT ",
 		LOG_ERR:     "ERRO ",
 		LOG_WARNING: "WARN ",
+		LOG_NOTICE:  "NOTE ",
 		LOG_INFO:    "INFO ",
 		LOG_DEBUG:   "DBUG ",
 	}
+	timeNames = map[int]string{
+		TIME_NONE:        "none",
+		TIME_DATETIME:    "datetime",
+		TIME_MSDATETIME:  "msdatetime",
+		TIME_TIMESTAMP:   "timestamp",
+		TIME_MSTIMESTAMP: "mstimestamp",
+	}
+	mergeNames = map[int]string{
+		MERGE_KEEP:     "keep",
+		MERGE_OVERRIDE: "override",
+		MERGE_PREFIX:   "prefix",
+	}
 	severityColors = map[int]string{
+		LOG_EMERG:   "\x1b[35m",
+		LOG_ALERT:   "\x1b[35m",
+		LOG_CRIT:    "\x1b[35m",
 		LOG_ERR:     "\x1b[31m",
 		LOG_WARNING: "\x1b[33m",
+		LOG_NOTICE:  "\x1b[34m",
 		LOG_INFO:    "\x1b[36m",
 		LOG_DEBUG:   "\x1b[32m",
 	}
 )
 
+type Output interface {
+	Write(now time.Time, severity int, message string, fields map[string]any, structured bool) error
+	Close()
+}
+
+var (
+	targets     = map[string]func(options map[string]string) Output{}
+	targetsLock sync.RWMutex
+	teesLock    sync.Mutex
+	named       = map[string]*atomic.Int64{}
+	namedLock   sync.Mutex
+)
+
+func RegisterTarget(name string, factory func(options map[string]string) Output) {
+	targetsLock.Lock()
+	targets[strings.ToLower(name)] = factory
+	targetsLock.Unlock()
+}
+
 type FileOutput struct {
 	handle *os.File
 	last   time.Time
 }
-type ULog struct {
+type Writer struct {
+	logger   *ULog
+	severity int
+}
+
+type Duration time.Duration
+type Bytes int64
+
+type Snapshot struct {
+	Outputs        []string
+	Disabled       bool
+	Level          string
+	UTC            bool
+	Merge          string
+	Fields         map[string]any
+	FilePath       string
+	FileTime       string
+	FileFacility   string
+	ConsoleTime    string
+	ConsoleFormat  string
+	SyslogRemote   string
+	SyslogName     string
+	SyslogFacility string
+}
+
+type config struct {
 	file, console, syslog bool
-	fileOutputs           map[string]*FileOutput
+	disabled              bool
 	filePath              string
+	fileLocation          *time.Location
 	fileTime              int
-	fileLast              time.Time
+	fileIdle              time.Duration
+	fileSync              time.Duration
 	fileSeverity          bool
+	fileColors            bool
 	fileFacility          int
+	fileLevelCase         string
+	fileBanner            string
 	consoleHandle         io.Writer
 	consoleTime           int
 	consoleSeverity       bool
 	consoleColors         bool
-	syslogHandle          *Syslog
+	consoleFields         int
+	consoleLevelStyle     string
+	consoleLevelCase      string
+	consoleFormat         string
 	syslogRemote          string
 	syslogName            string
 	syslogFacility        int
+	syslogBuffer          int
 	optionUTC             bool
+	oneline               string
 	level                 int
 	fields                map[string]any
+	order                 []string
+	ordered               bool
+	merge                 int
+	fatalExit             int
+	targets               []registered
+	sinks                 *sinks
+}
+
+type registered struct {
+	name    string
+	factory func(options map[string]string) Output
+	options map[string]string
+}
+
+type sinks struct {
+	files   map[string]*FileOutput
+	last    time.Time
+	squeue  chan entry
+	sdone   chan struct{}
+	fstop   chan struct{}
+	outputs []Output
+	names   []string
+	retired bool
+	lock    sync.Mutex
+	sync.RWMutex
+}
+
+type tee struct {
+	logger *ULog
+	level  int
+}
+
+type entry struct {
+	severity int
+	message  string
+}
+
+// a pre-serialized object with the default fields already spliced in, fields feed the structured outputs
+type raw struct {
+	data   []byte
+	fields map[string]any
+}
+
+type fault struct {
+	dest string
+	err  error
+}
+
+type ULog struct {
+	current      atomic.Pointer[config]
+	parent       *ULog
+	extra        map[string]any
+	named        *atomic.Int64
+	errors       map[string]uint64
+	errorHandler func(string, error)
+	sink         atomic.Pointer[func(int, string)]
+	once         sync.Map
+	tees         atomic.Pointer[[]tee]
 	sync.Mutex
 }
 
 func New(target string) *ULog {
-	l := &ULog{
-		fileOutputs:  map[string]*FileOutput{},
-		syslogHandle: nil,
-	}
+	l := &ULog{errors: map[string]uint64{}}
 	return l.Load(target)
 }
 
+func LevelName(level int) string {
+	return severityNames[level]
+}
+
+func ParseLevel(name string) (level int, ok bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if level, ok = severities[name]; ok {
+		return
+	}
+	if value, err := strconv.Atoi(name); err == nil && value >= LOG_EMERG && value <= LOG_DEBUG {
+		return value, true
+	}
+	return 0, false
+}
+
 func (l *ULog) Load(target string) *ULog {
-	l.Close()
-	l.Lock()
-	l.file = false
-	l.filePath = ""
-	l.fileTime = TIME_DATETIME
-	l.fileSeverity = true
-	l.console = false
-	l.consoleTime = TIME_DATETIME
-	l.consoleSeverity = true
-	l.consoleColors = true
-	l.consoleHandle = os.Stderr
-	l.syslog = false
-	l.syslogRemote = ""
-	l.syslogName = filepath.Base(os.Args[0])
-	l.syslogFacility = LOG_DAEMON
-	l.optionUTC = false
-	l.level = LOG_INFO
-	l.fields = map[string]any{}
-	console := os.Stderr
-	for _, target := range regexp.MustCompile(`(file|console|syslog|option)\s*\(([^\)]*)\)`).FindAllStringSubmatch(target, -1) {
+	if l.parent != nil {
+		l.parent.Load(target)
+		return l
+	}
+	c := &config{
+		fileTime:        TIME_DATETIME,
+		fileSeverity:    true,
+		fileIdle:        5 * time.Second,
+		consoleTime:     TIME_DATETIME,
+		consoleSeverity: true,
+		consoleColors:   true,
+		consoleFields:   -1,
+		consoleFormat:   "text",
+		consoleHandle:   os.Stderr,
+		syslogName:      filepath.Base(os.Args[0]),
+		syslogFacility:  LOG_DAEMON,
+		syslogBuffer:    1 << 10,
+		level:           LOG_INFO,
+		fields:          map[string]any{},
+		merge:           MERGE_KEEP,
+		fatalExit:       1,
+	}
+	console, auto := os.Stderr, false
+	for _, target := range regexp.MustCompile(`(\w+)\s*\(([^\)]*)\)`).FindAllStringSubmatch(target, -1) {
 		switch strings.ToLower(target[1]) {
 		case "file":
-			l.file = true
+			c.file = true
 			for _, option := range regexp.MustCompile(`([^:=,\s]+)\s*[:=]\s*([^,\s]+)`).FindAllStringSubmatch(target[2], -1) {
 				switch strings.ToLower(option[1]) {
 				case "path":
-					l.filePath = option[2]
+					c.filePath = option[2]
+				case "idle":
+					if value, err := time.ParseDuration(option[2]); err == nil && value >= 0 {
+						c.fileIdle = value
+					} else if value, err := strconv.Atoi(option[2]); err == nil && value >= 0 {
+						c.fileIdle = time.Duration(value) * time.Second
+					}
+				case "fsync":
+					// each sync forces a disk flush, bounding loss to one interval at the cost of write throughput
+					if value, err := time.ParseDuration(option[2]); err == nil && value > 0 {
+						c.fileSync = value
+					}
+				case "tz":
+					if location, err := time.LoadLocation(option[2]); err == nil {
+						c.fileLocation = location
+					}
 				case "time":
 					option[2] = strings.ToLower(option[2])
 					switch {
 					case option[2] == "datetime":
-						l.fileTime = TIME_DATETIME
+						c.fileTime = TIME_DATETIME
 					case option[2] == "msdatetime":
-						l.fileTime = TIME_MSDATETIME
+						c.fileTime = TIME_MSDATETIME
 					case option[2] == "stamp" || option[2] == "timestamp":
-						l.fileTime = TIME_TIMESTAMP
+						c.fileTime = TIME_TIMESTAMP
 					case option[2] == "msstamp" || option[2] == "mstimestamp":
-						l.fileTime = TIME_MSTIMESTAMP
+						c.fileTime = TIME_MSTIMESTAMP
 					case option[2] != "1" && option[2] != "true" && option[2] != "on" && option[2] != "yes":
-						l.fileTime = TIME_NONE
+						c.fileTime = TIME_NONE
 					}
 				case "severity":
 					option[2] = strings.ToLower(option[2])
 					if option[2] != "1" && option[2] != "true" && option[2] != "on" && option[2] != "yes" {
-						l.fileSeverity = false
+						c.fileSeverity = false
+					}
+				case "colors":
+					option[2] = strings.ToLower(option[2])
+					if option[2] == "1" || option[2] == "true" || option[2] == "on" || option[2] == "yes" {
+						c.fileColors = true
 					}
 				case "facility":
-					l.fileFacility = facilities[strings.ToLower(option[2])]
+					c.fileFacility = facilities[strings.ToLower(option[2])]
+				case "levelcase":
+					if option[2] = strings.ToLower(option[2]); option[2] == "lower" || option[2] == "upper" || option[2] == "short" {
+						c.fileLevelCase = option[2]
+					}
+				case "banner":
+					// on uses the default marker, any other value is a template ({name}, {version}, {pid} and strftime sequences)
+					switch strings.ToLower(option[2]) {
+					case "1", "true", "on", "yes":
+						c.fileBanner = "--- %Y-%m-%d %H:%M:%S {name} {version} pid={pid} ---"
+					case "0", "false", "off", "no":
+						c.fileBanner = ""
+					default:
+						c.fileBanner = option[2]
+					}
 				}
 			}
-			if l.filePath == "" {
-				l.file = false
+			if c.filePath == "" {
+				c.file = false
 			}
 		case "console":
-			l.console = true
+			c.console = true
 			for _, option := range regexp.MustCompile(`([^:=,\s]+)\s*[:=]\s*([^,\s]+)`).FindAllStringSubmatch(target[2], -1) {
 				option[2] = strings.ToLower(option[2])
 				switch strings.ToLower(option[1]) {
 				case "output":
 					if option[2] == "stdout" {
-						l.consoleHandle = os.Stdout
+						c.consoleHandle = os.Stdout
 						console = os.Stdout
 					}
 				case "time":
 					switch {
 					case option[2] == "datetime":
-						l.consoleTime = TIME_DATETIME
+						c.consoleTime = TIME_DATETIME
 					case option[2] == "msdatetime":
-						l.consoleTime = TIME_MSDATETIME
+						c.consoleTime = TIME_MSDATETIME
 					case option[2] == "stamp" || option[2] == "timestamp":
-						l.consoleTime = TIME_TIMESTAMP
+						c.consoleTime = TIME_TIMESTAMP
 					case option[2] == "msstamp" || option[2] == "mstimestamp":
-						l.consoleTime = TIME_MSTIMESTAMP
+						c.consoleTime = TIME_MSTIMESTAMP
 					case option[2] != "1" && option[2] != "true" && option[2] != "on" && option[2] != "yes":
-						l.consoleTime = TIME_NONE
+						c.consoleTime = TIME_NONE
 					}
 				case "severity":
 					if option[2] != "1" && option[2] != "true" && option[2] != "on" && option[2] != "yes" {
-						l.consoleSeverity = false
+						c.consoleSeverity = false
 					}
 				case "colors":
 					if option[2] != "1" && option[2] != "true" && option[2] != "on" && option[2] != "yes" {
-						l.consoleColors = false
+						c.consoleColors = false
+					}
+				case "fields":
+					if value, ok := severities[option[2]]; ok {
+						c.consoleFields = value
+					}
+				case "levelstyle":
+					if option[2] == "name" || option[2] == "number" || option[2] == "both" {
+						c.consoleLevelStyle = option[2]
+					}
+				case "levelcase":
+					if option[2] == "lower" || option[2] == "upper" || option[2] == "short" {
+						c.consoleLevelCase = option[2]
+					}
+				case "format":
+					if option[2] == "text" || option[2] == "json" {
+						c.consoleFormat = option[2]
+					}
+				case "auto":
+					if option[2] == "1" || option[2] == "true" || option[2] == "on" || option[2] == "yes" {
+						auto = true
 					}
 				}
 			}
 		case "syslog":
-			l.syslog = true
+			c.syslog = true
 			for _, option := range regexp.MustCompile(`([^:=,\s]+)\s*[:=]\s*([^,\s]+)`).FindAllStringSubmatch(target[2], -1) {
 				switch strings.ToLower(option[1]) {
 				case "remote":
-					l.syslogRemote = option[2]
-					if !regexp.MustCompile(`:\d+$`).MatchString(l.syslogRemote) {
-						l.syslogRemote += ":514"
+					c.syslogRemote = option[2]
+					if !regexp.MustCompile(`:\d+$`).MatchString(c.syslogRemote) {
+						c.syslogRemote += ":514"
 					}
 				case "name":
-					l.syslogName = option[2]
+					c.syslogName = option[2]
 				case "facility":
-					l.syslogFacility = facilities[strings.ToLower(option[2])]
+					c.syslogFacility = facilities[strings.ToLower(option[2])]
+				case "buffer":
+					if value, err := strconv.Atoi(option[2]); err == nil && value > 0 {
+						c.syslogBuffer = value
+					}
 				}
 			}
 		case "option":
 			for _, option := range regexp.MustCompile(`([^:=,\s]+)\s*[:=]\s*([^,\s]+)`).FindAllStringSubmatch(target[2], -1) {
+				value := option[2]
 				option[2] = strings.ToLower(option[2])
 				switch strings.ToLower(option[1]) {
 				case "utc":
 					if option[2] == "1" || option[2] == "true" || option[2] == "on" || option[2] == "yes" {
-						l.optionUTC = true
+						c.optionUTC = true
+					}
+				case "oneline":
+					switch option[2] {
+					case "1", "true", "on", "yes":
+						c.oneline = `\n`
+					case "0", "false", "off", "no":
+						c.oneline = ""
+					default:
+						c.oneline = value
+					}
+				case "ordered":
+					// default fields are written first in insertion order, at a small cost over plain map encoding
+					if option[2] == "1" || option[2] == "true" || option[2] == "on" || option[2] == "yes" {
+						c.ordered = true
 					}
 				case "level":
-					l.level = severities[strings.ToLower(option[2])]
+					if value, ok := ParseLevel(option[2]); ok {
+						c.level = value
+					}
+				case "version":
+					c.fields["version"] = value
+					c.order = append(c.order, "version")
+				case "merge":
+					switch option[2] {
+					case "keep":
+						c.merge = MERGE_KEEP
+					case "override":
+						c.merge = MERGE_OVERRIDE
+					case "prefix":
+						c.merge = MERGE_PREFIX
+					}
+				case "fatalexit":
+					if value, err := strconv.Atoi(option[2]); err == nil {
+						c.fatalExit = value
+					}
+				}
+			}
+		case "null":
+			c.disabled = true
+		default:
+			targetsLock.RLock()
+			factory := targets[strings.ToLower(target[1])]
+			targetsLock.RUnlock()
+			if factory != nil {
+				options := map[string]string{}
+				for _, option := range regexp.MustCompile(`([^:=,\s]+)\s*[:=]\s*([^,\s]+)`).FindAllStringSubmatch(target[2], -1) {
+					options[strings.ToLower(option[1])] = option[2]
 				}
+				c.targets = append(c.targets, registered{name: strings.ToLower(target[1]), factory: factory, options: options})
 			}
 		}
 	}
 
 	if info, err := console.Stat(); err == nil {
 		if info.Mode()&(os.ModeDevice|os.ModeCharDevice) != os.ModeDevice|os.ModeCharDevice {
-			l.consoleColors = false
+			c.consoleColors = false
+			if auto {
+				c.consoleFormat = "json"
+			}
+		} else if auto {
+			c.consoleFormat = "text"
 		}
 	}
 	if runtime.GOOS == "windows" {
-		l.consoleColors = false
+		c.consoleColors = false
 	}
+	c.sinks = c.open()
+	l.Lock()
+	previous := l.current.Swap(c)
 	l.Unlock()
+	if previous != nil {
+		previous.sinks.retire()
+	}
 	return l
 }
 
 func (l *ULog) Close() {
+	l = l.base()
 	l.Lock()
-	if l.syslogHandle != nil {
-		l.syslogHandle.Close()
-		l.syslogHandle = nil
+	previous := l.current.Load()
+	c := *previous
+	c.sinks = c.open()
+	l.current.Store(&c)
+	l.Unlock()
+	previous.sinks.retire()
+}
+
+// file and syslog outputs reopen lazily, registered targets are rebuilt from their factory and options
+func (c *config) open() *sinks {
+	s := &sinks{files: map[string]*FileOutput{}}
+	if c.file && c.fileSync > 0 {
+		s.fstop = make(chan struct{})
+		go s.sync(c.fileSync)
+	}
+	for _, target := range c.targets {
+		if output := target.factory(target.options); output != nil {
+			s.outputs = append(s.outputs, output)
+			s.names = append(s.names, target.name)
+		}
+	}
+	return s
+}
+
+func (s *sinks) retire() {
+	s.Lock()
+	s.retired = true
+	if s.squeue != nil {
+		close(s.squeue)
+	}
+	if s.fstop != nil {
+		close(s.fstop)
 	}
-	for path, output := range l.fileOutputs {
+	s.lock.Lock()
+	for path, output := range s.files {
 		if output.handle != nil {
 			output.handle.Close()
 		}
-		delete(l.fileOutputs, path)
+		delete(s.files, path)
+	}
+	s.lock.Unlock()
+	for _, output := range s.outputs {
+		output.Close()
 	}
+	s.outputs = nil
+	s.Unlock()
+	if s.sdone != nil {
+		select {
+		case <-s.sdone:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *sinks) sync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.fstop:
+			return
+		case <-ticker.C:
+			handles := []*os.File{}
+			s.lock.Lock()
+			for _, output := range s.files {
+				if output.handle != nil {
+					handles = append(handles, output.handle)
+				}
+			}
+			s.lock.Unlock()
+			for _, handle := range handles {
+				handle.Sync()
+			}
+		}
+	}
+}
+
+func (s *sinks) drain(remote string, facility int, name string) {
+	var handle *Syslog
+	var err error
+
+	protocol := ""
+	if remote != "" {
+		protocol = "udp"
+	}
+	for entry := range s.squeue {
+		if handle == nil {
+			if handle, err = DialSyslog(protocol, remote, facility, name); err != nil {
+				handle = nil
+				continue
+			}
+		}
+		switch entry.severity {
+		case LOG_EMERG:
+			handle.Emerg(entry.message)
+		case LOG_ALERT:
+			handle.Alert(entry.message)
+		case LOG_CRIT:
+			handle.Crit(entry.message)
+		case LOG_ERR:
+			handle.Err(entry.message)
+		case LOG_WARNING:
+			handle.Warning(entry.message)
+		case LOG_NOTICE:
+			handle.Notice(entry.message)
+		case LOG_INFO:
+			handle.Info(entry.message)
+		case LOG_DEBUG:
+			handle.Debug(entry.message)
+		}
+	}
+	if handle != nil {
+		handle.Close()
+	}
+	close(s.sdone)
+}
+
+func (l *ULog) base() *ULog {
+	if l.parent != nil {
+		return l.parent
+	}
+	return l
+}
+
+func (l *ULog) view(c *config) *config {
+	if len(l.extra) == 0 {
+		return c
+	}
+	view := *c
+	view.fields = make(map[string]any, len(c.fields)+len(l.extra))
+	for key, value := range c.fields {
+		view.fields[key] = value
+	}
+	keys := make([]string, 0, len(l.extra))
+	for key, value := range l.extra {
+		if _, ok := c.fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		view.fields[key] = value
+	}
+	sort.Strings(keys)
+	view.order = append(append([]string{}, c.order...), keys...)
+	return &view
+}
+
+func (l *ULog) acquire() *config {
+	for {
+		c := l.base().current.Load()
+		c.sinks.RLock()
+		if !c.sinks.retired {
+			return l.view(c)
+		}
+		c.sinks.RUnlock()
+	}
+}
+
+func (l *ULog) update(change func(c *config)) {
+	l = l.base()
+	l.Lock()
+	c := *l.current.Load()
+	c.fields = make(map[string]any, len(c.fields))
+	for key, value := range l.current.Load().fields {
+		c.fields[key] = value
+	}
+	c.order = append([]string{}, c.order...)
+	change(&c)
+	l.current.Store(&c)
 	l.Unlock()
 }
 
 func (l *ULog) SetLevel(level string) {
-	level = strings.ToLower(level)
-	switch level {
-	case "error":
-		l.level = LOG_ERR
-	case "warning":
-		l.level = LOG_WARNING
-	case "info":
-		l.level = LOG_INFO
-	case "debug":
-		l.level = LOG_DEBUG
+	if value, ok := ParseLevel(level); ok {
+		l.update(func(c *config) {
+			c.level = value
+		})
+	}
+}
+
+func (l *ULog) Disable() {
+	l.update(func(c *config) {
+		c.disabled = true
+	})
+}
+
+func (l *ULog) Config() Snapshot {
+	c := l.acquire()
+	defer c.sinks.RUnlock()
+	snapshot := Snapshot{
+		Disabled:       c.disabled,
+		Level:          severityNames[c.level],
+		UTC:            c.optionUTC,
+		Merge:          mergeNames[c.merge],
+		Fields:         make(map[string]any, len(c.fields)),
+		ConsoleFormat:  c.consoleFormat,
+		SyslogRemote:   c.syslogRemote,
+		SyslogName:     c.syslogName,
+		SyslogFacility: facility(c.syslogFacility),
+	}
+	for key, value := range c.fields {
+		snapshot.Fields[key] = value
+	}
+	if c.file {
+		snapshot.Outputs = append(snapshot.Outputs, "file")
+		snapshot.FilePath, snapshot.FileTime, snapshot.FileFacility = c.filePath, timeNames[c.fileTime], facility(c.fileFacility)
+	}
+	if c.console {
+		snapshot.Outputs = append(snapshot.Outputs, "console")
+		snapshot.ConsoleTime = timeNames[c.consoleTime]
+	}
+	if c.syslog {
+		snapshot.Outputs = append(snapshot.Outputs, "syslog")
+	}
+	snapshot.Outputs = append(snapshot.Outputs, c.sinks.names...)
+	return snapshot
+}
+
+func (l *ULog) SetSink(sink func(severity int, message string)) {
+	l = l.base()
+	if sink == nil {
+		l.sink.Store(nil)
+	} else {
+		l.sink.Store(&sink)
+	}
+}
+
+func (l *ULog) SetErrorHandler(handler func(dest string, err error)) {
+	l = l.base()
+	l.Lock()
+	l.errorHandler = handler
+	l.Unlock()
+}
+
+func (l *ULog) Errors() map[string]uint64 {
+	l = l.base()
+	l.Lock()
+	defer l.Unlock()
+	errors := make(map[string]uint64, len(l.errors))
+	for dest, count := range l.errors {
+		errors[dest] = count
+	}
+	return errors
+}
+
+func (l *ULog) WithFields(fields map[string]any) *ULog {
+	child := &ULog{parent: l.base(), named: l.named, extra: make(map[string]any, len(l.extra)+len(fields))}
+	for key, value := range l.extra {
+		child.extra[key] = value
+	}
+	for key, value := range fields {
+		child.extra[key] = value
+	}
+	return child
+}
+
+func (l *ULog) Named(name string) *ULog {
+	child := l.WithFields(map[string]any{"logger": name})
+	namedLock.Lock()
+	if named[name] == nil {
+		named[name] = &atomic.Int64{}
+		named[name].Store(-1)
+	}
+	child.named = named[name]
+	namedLock.Unlock()
+	return child
+}
+
+func SetNamedLevel(name, level string) {
+	value, ok := ParseLevel(level)
+	if !ok {
+		if level != "" && strings.ToLower(level) != "inherit" {
+			return
+		}
+		value = -1
+	}
+	namedLock.Lock()
+	if named[name] == nil {
+		named[name] = &atomic.Int64{}
 	}
+	named[name].Store(int64(value))
+	namedLock.Unlock()
+}
+
+func (l *ULog) threshold(c *config) int {
+	if l.named != nil {
+		if value := l.named.Load(); value >= 0 {
+			return int(value)
+		}
+	}
+	return c.level
+}
+
+func (l *ULog) WithError(err error) *ULog {
+	if err == nil {
+		return l
+	}
+	return l.WithFields(map[string]any{"error": err.Error(), "errtype": fmt.Sprintf("%T", err)})
+}
+
+func (l *ULog) Tee(other *ULog, minLevel int) error {
+	l, other = l.base(), other.base()
+	teesLock.Lock()
+	defer teesLock.Unlock()
+	if other.reaches(l) {
+		return errors.New(`ulog: tee would create a loop`)
+	}
+	list := []tee{}
+	if current := l.tees.Load(); current != nil {
+		list = append(list, *current...)
+	}
+	list = append(list, tee{logger: other, level: minLevel})
+	l.tees.Store(&list)
+	return nil
+}
+
+func (l *ULog) reaches(target *ULog) bool {
+	if l == target {
+		return true
+	}
+	if list := l.tees.Load(); list != nil {
+		for _, tee := range *list {
+			if tee.logger.reaches(target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *ULog) SetMergeStrategy(strategy int) {
+	if strategy >= MERGE_KEEP && strategy <= MERGE_PREFIX {
+		l.update(func(c *config) {
+			c.merge = strategy
+		})
+	}
+}
+
+func (l *ULog) SetFatalExit(code int) {
+	l.update(func(c *config) {
+		c.fatalExit = code
+	})
+}
+
+func (l *ULog) SetVersion(version string) {
+	l.SetField("version", version)
 }
 
 func (l *ULog) SetField(key string, value any) {
-	l.fields[key] = value
+	l.update(func(c *config) {
+		if _, ok := c.fields[key]; !ok {
+			c.order = append(c.order, key)
+		}
+		c.fields[key] = value
+	})
 }
 func (l *ULog) SetFields(fields map[string]any) {
-	for key, value := range fields {
-		l.fields[key] = value
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	l.update(func(c *config) {
+		for _, key := range keys {
+			if _, ok := c.fields[key]; !ok {
+				c.order = append(c.order, key)
+			}
+			c.fields[key] = fields[key]
+		}
+	})
 }
 func (l *ULog) ClearFields() {
-	l.fields = map[string]any{}
+	l.update(func(c *config) {
+		c.fields, c.order = map[string]any{}, nil
+	})
+}
+
+func facility(value int) string {
+	for name, facility := range facilities {
+		if facility == value {
+			return name
+		}
+	}
+	return ""
 }
 
 func strftime(layout string, base time.Time) string {
@@ -361,6 +1002,8 @@ func strftime(layout string, base time.Time) string {
 					output = append(output, fmt.Sprintf("%02d", base.Minute()))
 				case 'n':
 					output = append(output, "\n")
+				case 'N':
+					output = append(output, fmt.Sprintf("%09d", base.Nanosecond()))
 				case 'p':
 					if base.Hour() < 12 {
 						output = append(output, "AM")
@@ -440,149 +1083,513 @@ func strftime(layout string, base time.Time) string {
 	return strings.Join(output, "")
 }
 
-func (l *ULog) log(now time.Time, severity int, input any, a ...any) {
-	var err error
-	if l.level < severity || (!l.syslog && !l.file && !l.console) {
-		return
+func merge(target, fields map[string]any, strategy int) {
+	for key, value := range fields {
+		current, parts := target, strings.Split(key, ".")
+		for index := 0; index < len(parts)-1; index++ {
+			if next, ok := current[parts[index]].(map[string]any); ok {
+				current = next
+			} else {
+				current[parts[index]] = map[string]any{}
+				current = current[parts[index]].(map[string]any)
+			}
+		}
+		name := parts[len(parts)-1]
+		switch {
+		case current[name] == nil || strategy == MERGE_OVERRIDE:
+			current[name] = value
+		case strategy == MERGE_PREFIX:
+			current["_"+name] = value
+		}
 	}
-	layout := ""
-	if current, ok := input.(map[string]any); ok {
-		var buffer bytes.Buffer
+}
 
-		for key, value := range l.fields {
-			parts := strings.Split(key, ".")
-			for index := 0; index < len(parts)-1; index++ {
-				if next, ok := current[parts[index]].(map[string]any); ok {
-					current = next
-				} else {
-					current[parts[index]] = map[string]any{}
-					current = current[parts[index]].(map[string]any)
+func stamp(mode int, now time.Time) string {
+	switch mode {
+	case TIME_DATETIME:
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
+	case TIME_MSDATETIME:
+		return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%03d", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), now.Nanosecond()/int(time.Millisecond))
+	case TIME_TIMESTAMP:
+		return fmt.Sprintf("%d", now.Unix())
+	case TIME_MSTIMESTAMP:
+		return fmt.Sprintf("%d", now.UnixNano()/int64(time.Millisecond))
+	}
+	return ""
+}
+
+func levels(object map[string]any, severity int, style string) {
+	if _, ok := object["level"]; !ok {
+		if style == "number" {
+			object["level"] = severity
+		} else {
+			object["level"] = severityNames[severity]
+		}
+	}
+	if _, ok := object["level_num"]; !ok && style == "both" {
+		object["level_num"] = severity
+	}
+}
+
+func label(severity int, mode string) string {
+	switch mode {
+	case "lower":
+		return severityNames[severity] + " "
+	case "upper":
+		return strings.ToUpper(severityNames[severity]) + " "
+	case "short":
+		return strings.ToUpper(severityNames[severity][:1]) + " "
+	}
+	return severityLabels[severity]
+}
+
+func (c *config) encode(object map[string]any) ([]byte, error) {
+	if !c.ordered {
+		return encode(object)
+	}
+	keys, seen := []string{}, map[string]bool{}
+	for _, key := range c.order {
+		if index := strings.Index(key, "."); index >= 0 {
+			key = key[:index]
+		}
+		if _, ok := object[key]; ok && !seen[key] {
+			keys, seen[key] = append(keys, key), true
+		}
+	}
+	rest := []string{}
+	for key := range object {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	buffer := bytes.NewBufferString("{")
+	for index, key := range append(keys, rest...) {
+		name, _ := encode(key)
+		value, err := encode(object[key])
+		if err != nil {
+			return nil, err
+		}
+		if index > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(name)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// the encoded fields are inserted after the opening brace, the rest of data is kept byte for byte
+func (c *config) splice(data []byte, fields map[string]any) []byte {
+	if len(fields) == 0 {
+		return data
+	}
+	encoded, err := c.encode(fields)
+	if err != nil {
+		return data
+	}
+	spliced := append(make([]byte, 0, len(data)+len(encoded)), encoded[:len(encoded)-1]...)
+	if rest := bytes.TrimSpace(data[1:]); len(rest) != 0 && rest[0] != '}' {
+		spliced = append(spliced, ',')
+	}
+	return append(spliced, data[1:]...)
+}
+
+func encode(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buffer.Bytes()), nil
+}
+
+func dump(fields map[string]any) string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	output := []string{}
+	for _, key := range keys {
+		output = append(output, fmt.Sprintf(" %s=%v", key, fields[key]))
+	}
+	return strings.Join(output, "")
+}
+
+func (l *ULog) log(now time.Time, severity int, input any, a ...any) {
+	if tees := l.base().tees.Load(); tees != nil && !l.base().current.Load().disabled {
+		for _, tee := range *tees {
+			if severity <= tee.level {
+				logger, forward := tee.logger, input
+				if len(l.extra) != 0 {
+					logger = logger.WithFields(l.extra)
 				}
-			}
-			if current[parts[len(parts)-1]] == nil {
-				current[parts[len(parts)-1]] = value
+				if current, ok := input.(map[string]any); ok {
+					object := make(map[string]any, len(current))
+					for key, value := range current {
+						object[key] = value
+					}
+					forward = object
+				}
+				logger.log(now, severity, forward, a...)
 			}
 		}
-		encoder := json.NewEncoder(&buffer)
-		encoder.SetEscapeHTML(false)
-		if err := encoder.Encode(input); err == nil {
+	}
+	if c := l.base().current.Load(); c.disabled || l.threshold(c) < severity || (!c.syslog && !c.file && !c.console && len(c.sinks.outputs) == 0 && l.base().sink.Load() == nil) {
+		return
+	}
+	var forward func(int, string)
+
+	faults, forwarded := []fault{}, ""
+	c := l.acquire()
+	// the error handler and the sink run once the sinks are released, they may log, Load or Close
+	defer func() {
+		c.sinks.RUnlock()
+		l.report(faults)
+		if forward != nil {
+			forward(severity, forwarded)
+		}
+	}()
+	if l.threshold(c) < severity {
+		return
+	}
+	layout, fields := "", c.fields
+	if current, ok := input.(map[string]any); ok {
+		fields = current
+		merge(current, c.fields, c.merge)
+		if encoded, err := c.encode(current); err == nil {
 			layout = "%s"
-			a = []any{bytes.TrimSpace(buffer.Bytes())}
+			a = []any{encoded}
 		}
+	} else if current, ok := input.(raw); ok {
+		fields, layout, a = current.fields, "%s", []any{current.data}
 	} else if _, ok := input.(string); ok {
 		layout = input.(string)
 	}
-	layout = strings.TrimSpace(layout)
-	if l.syslog {
-		if l.syslogHandle == nil {
-			l.Lock()
-			if l.syslogHandle == nil {
-				protocol := ""
-				if l.syslogRemote != "" {
-					protocol = "udp"
-				}
-				if l.syslogHandle, err = DialSyslog(protocol, l.syslogRemote, l.syslogFacility, l.syslogName); err != nil {
-					l.syslogHandle = nil
-				}
-			}
-			l.Unlock()
-		}
-		if l.syslogHandle != nil {
-			switch severity {
-			case LOG_ERR:
-				l.syslogHandle.Err(fmt.Sprintf(layout, a...))
-			case LOG_WARNING:
-				l.syslogHandle.Warning(fmt.Sprintf(layout, a...))
-			case LOG_INFO:
-				l.syslogHandle.Info(fmt.Sprintf(layout, a...))
-			case LOG_DEBUG:
-				l.syslogHandle.Debug(fmt.Sprintf(layout, a...))
-			}
+	layout, extra := strings.TrimSpace(layout), ""
+	if _, ok := input.(string); ok && len(l.extra) != 0 {
+		extra = dump(l.extra)
+	}
+	if _, ok := input.(string); ok && c.oneline != "" {
+		layout, a = "%s", []any{strings.ReplaceAll(strings.ReplaceAll(fmt.Sprintf(layout, a...), "\r\n", "\n"), "\n", c.oneline)}
+	}
+	if c.syslog {
+		c.sinks.lock.Lock()
+		if c.sinks.squeue == nil {
+			c.sinks.squeue, c.sinks.sdone = make(chan entry, c.syslogBuffer), make(chan struct{})
+			go c.sinks.drain(c.syslogRemote, c.syslogFacility, c.syslogName)
+		}
+		c.sinks.lock.Unlock()
+		select {
+		case c.sinks.squeue <- entry{severity, fmt.Sprintf(layout, a...) + extra}:
+		default:
+			base := l.base()
+			base.Lock()
+			base.errors["syslog"]++
+			base.Unlock()
 		}
 	}
-	if l.optionUTC {
+	if c.optionUTC {
 		now = now.UTC()
 	} else {
 		now = now.Local()
 	}
-	if l.file {
-		path := strftime(l.filePath, now)
-		l.Lock()
-		if l.fileOutputs[path] == nil {
+	if c.file {
+		var failure error
+
+		path := ""
+		if c.fileLocation != nil {
+			path = strftime(c.filePath, now.In(c.fileLocation))
+		} else {
+			path = strftime(c.filePath, now)
+		}
+		c.sinks.lock.Lock()
+		if c.sinks.files[path] == nil {
 			os.MkdirAll(filepath.Dir(path), 0755)
 			if handle, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|syscall.O_NONBLOCK, 0644); err == nil {
-				l.fileOutputs[path] = &FileOutput{handle: handle}
+				c.sinks.files[path] = &FileOutput{handle: handle}
+				if c.fileBanner != "" {
+					version := ""
+					if value, ok := c.fields["version"]; ok {
+						version = fmt.Sprintf("%v", value)
+					}
+					banner := strings.NewReplacer("{name}", c.syslogName, "{version}", version, "{pid}", strconv.Itoa(os.Getpid())).Replace(strftime(c.fileBanner, now))
+					if _, err := handle.WriteString(banner + "\n"); err != nil {
+						failure = err
+					}
+				}
+			} else {
+				failure = err
 			}
 		}
-		if l.fileOutputs[path] != nil && l.fileOutputs[path].handle != nil {
+		if c.sinks.files[path] != nil && c.sinks.files[path].handle != nil {
 			prefix := ""
-			if l.fileFacility != 0 {
-				prefix = fmt.Sprintf("<%d>%s %s[%d]: ", l.fileFacility|severity, now.Format(time.Stamp), l.syslogName, os.Getpid())
+			if c.fileFacility != 0 {
+				prefix = fmt.Sprintf("<%d>%s %s[%d]: ", c.fileFacility|severity, now.Format(time.Stamp), c.syslogName, os.Getpid())
 			} else {
-				switch l.fileTime {
-				case TIME_DATETIME:
-					prefix = fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d ", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
-				case TIME_MSDATETIME:
-					prefix = fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%03d ", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), now.Nanosecond()/int(time.Millisecond))
-				case TIME_TIMESTAMP:
-					prefix = fmt.Sprintf("%d ", now.Unix())
-				case TIME_MSTIMESTAMP:
-					prefix = fmt.Sprintf("%d ", now.UnixNano()/int64(time.Millisecond))
+				if c.fileTime != TIME_NONE {
+					prefix = stamp(c.fileTime, now) + " "
 				}
-				if l.fileSeverity {
-					prefix += severityLabels[severity]
+				if c.fileSeverity {
+					if c.fileColors {
+						prefix += fmt.Sprintf("%s%s\x1b[0m", severityColors[severity], label(severity, c.fileLevelCase))
+					} else {
+						prefix += label(severity, c.fileLevelCase)
+					}
 				}
 			}
-			l.fileOutputs[path].handle.WriteString(fmt.Sprintf(prefix+layout+"\n", a...))
-			l.fileOutputs[path].last = now
+			if _, err := c.sinks.files[path].handle.WriteString(fmt.Sprintf(prefix+layout, a...) + extra + "\n"); err != nil {
+				failure = err
+			}
+			c.sinks.files[path].last = now
 		}
-		if now.Sub(l.fileLast) >= 5*time.Second {
-			l.fileLast = now
-			for path, output := range l.fileOutputs {
-				if now.Sub(output.last) >= 5*time.Second {
+		if c.fileIdle > 0 && now.Sub(c.sinks.last) >= c.fileIdle {
+			c.sinks.last = now
+			for path, output := range c.sinks.files {
+				if now.Sub(output.last) >= c.fileIdle {
 					output.handle.Close()
-					delete(l.fileOutputs, path)
+					delete(c.sinks.files, path)
 				}
 			}
 		}
-		l.Unlock()
-	}
-	if l.console {
-		prefix := ""
-		switch l.consoleTime {
-		case TIME_DATETIME:
-			prefix = fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d ", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
-		case TIME_MSDATETIME:
-			prefix = fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d.%03d ", now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), now.Nanosecond()/int(time.Millisecond))
-		case TIME_TIMESTAMP:
-			prefix = fmt.Sprintf("%d ", now.Unix())
-		case TIME_MSTIMESTAMP:
-			prefix = fmt.Sprintf("%d ", now.UnixNano()/int64(time.Millisecond))
-		}
-		if l.consoleSeverity {
-			if l.consoleColors {
-				prefix += fmt.Sprintf("%s%s\x1b[0m", severityColors[severity], severityLabels[severity])
+		c.sinks.lock.Unlock()
+		if failure != nil {
+			faults = append(faults, fault{path, failure})
+		}
+	}
+	if c.console {
+		if c.consoleFormat == "json" {
+			object := map[string]any{}
+			if current, ok := input.(map[string]any); ok {
+				for key, value := range current {
+					object[key] = value
+				}
+			} else if _, ok := input.(raw); !ok {
+				merge(object, c.fields, c.merge)
+				object["message"] = fmt.Sprintf(layout, a...)
+			}
+			if _, ok := object["time"]; !ok {
+				switch c.consoleTime {
+				case TIME_DATETIME, TIME_MSDATETIME:
+					object["time"] = stamp(c.consoleTime, now)
+				case TIME_TIMESTAMP, TIME_MSTIMESTAMP:
+					object["time"] = json.Number(stamp(c.consoleTime, now))
+				}
+			}
+			levels(object, severity, c.consoleLevelStyle)
+			if current, ok := input.(raw); ok {
+				for key := range current.fields {
+					delete(object, key)
+				}
+				c.sinks.lock.Lock()
+				fmt.Fprintf(c.consoleHandle, "%s\n", c.splice(current.data, object))
+				c.sinks.lock.Unlock()
+			} else if encoded, err := c.encode(object); err == nil {
+				c.sinks.lock.Lock()
+				fmt.Fprintf(c.consoleHandle, "%s\n", encoded)
+				c.sinks.lock.Unlock()
+			}
+		} else {
+			prefix := ""
+			if c.consoleTime != TIME_NONE {
+				prefix = stamp(c.consoleTime, now) + " "
+			}
+			if c.consoleSeverity {
+				if c.consoleColors {
+					prefix += fmt.Sprintf("%s%s\x1b[0m", severityColors[severity], label(severity, c.consoleLevelCase))
+				} else {
+					prefix += label(severity, c.consoleLevelCase)
+				}
+			}
+			message, suffix := "", ""
+			if current, ok := input.(map[string]any); ok && c.consoleLevelStyle != "" {
+				object := make(map[string]any, len(current)+2)
+				for key, value := range current {
+					object[key] = value
+				}
+				levels(object, severity, c.consoleLevelStyle)
+				if encoded, err := c.encode(object); err == nil {
+					message = string(encoded)
+				}
+			} else if current, ok := input.(raw); ok && c.consoleLevelStyle != "" {
+				object := map[string]any{}
+				levels(object, severity, c.consoleLevelStyle)
+				for key := range current.fields {
+					delete(object, key)
+				}
+				message = string(c.splice(current.data, object))
+			} else {
+				message = fmt.Sprintf(layout, a...)
+			}
+			if _, ok := input.(string); ok && severity <= c.consoleFields && len(c.fields) != 0 {
+				suffix = dump(c.fields)
 			} else {
-				prefix += severityLabels[severity]
+				suffix = extra
 			}
+			c.sinks.lock.Lock()
+			fmt.Fprintf(c.consoleHandle, "%s%s%s\n", prefix, message, suffix)
+			c.sinks.lock.Unlock()
+		}
+	}
+	if len(c.sinks.outputs) != 0 {
+		message, structured := fmt.Sprintf(layout, a...), false
+		switch input.(type) {
+		case map[string]any, raw:
+			structured = true
+		}
+		for index, output := range c.sinks.outputs {
+			if err := output.Write(now, severity, message, fields, structured); err != nil {
+				faults = append(faults, fault{c.sinks.names[index], err})
+			}
+		}
+	}
+	if sink := l.base().sink.Load(); sink != nil {
+		forward, forwarded = *sink, fmt.Sprintf(layout, a...)
+	}
+}
+
+func (l *ULog) report(faults []fault) {
+	if len(faults) == 0 {
+		return
+	}
+	base := l.base()
+	base.Lock()
+	for _, fault := range faults {
+		base.errors[fault.dest]++
+	}
+	handler := base.errorHandler
+	base.Unlock()
+	if handler != nil {
+		for _, fault := range faults {
+			handler(fault.dest, fault.err)
 		}
-		l.Lock()
-		fmt.Fprintf(l.consoleHandle, prefix+layout+"\n", a...)
-		l.Unlock()
 	}
 }
 
+func (l *ULog) Log(severity int, layout any, a ...any) {
+	if severity < LOG_EMERG {
+		severity = LOG_EMERG
+	}
+	if severity > LOG_DEBUG {
+		severity = LOG_DEBUG
+	}
+	l.log(time.Now(), severity, layout, a...)
+}
 func (l *ULog) Error(layout any, a ...any) {
-	l.log(time.Now(), LOG_ERR, layout, a...)
+	l.Log(LOG_ERR, layout, a...)
 }
 func (l *ULog) Warn(layout any, a ...any) {
-	l.log(time.Now(), LOG_WARNING, layout, a...)
+	l.Log(LOG_WARNING, layout, a...)
 }
 func (l *ULog) Info(layout any, a ...any) {
-	l.log(time.Now(), LOG_INFO, layout, a...)
+	l.Log(LOG_INFO, layout, a...)
 }
 func (l *ULog) Debug(layout any, a ...any) {
-	l.log(time.Now(), LOG_DEBUG, layout, a...)
+	l.Log(LOG_DEBUG, layout, a...)
+}
+
+func (l *ULog) Fatal(layout any, a ...any) {
+	l.Log(LOG_CRIT, layout, a...)
+	code := l.base().current.Load().fatalExit
+	l.Close()
+	os.Exit(code)
+}
+
+// preferred for expensive payloads: the closure only runs when the entry would be written somewhere
+func (l *ULog) ErrorFn(build func() (string, map[string]any)) {
+	l.lazy(LOG_ERR, build)
+}
+func (l *ULog) WarnFn(build func() (string, map[string]any)) {
+	l.lazy(LOG_WARNING, build)
+}
+func (l *ULog) InfoFn(build func() (string, map[string]any)) {
+	l.lazy(LOG_INFO, build)
+}
+func (l *ULog) DebugFn(build func() (string, map[string]any)) {
+	l.lazy(LOG_DEBUG, build)
+}
+
+func (l *ULog) lazy(severity int, build func() (string, map[string]any)) {
+	if !l.enabled(severity) {
+		return
+	}
+	message, fields := build()
+	if fields == nil {
+		l.log(time.Now(), severity, "%s", message)
+		return
+	}
+	object := make(map[string]any, len(fields)+1)
+	for key, value := range fields {
+		object[key] = value
+	}
+	if message != "" {
+		object["message"] = message
+	}
+	l.log(time.Now(), severity, object)
+}
+
+func (l *ULog) enabled(severity int) bool {
+	base := l.base()
+	c := base.current.Load()
+	if c.disabled {
+		return false
+	}
+	if tees := base.tees.Load(); tees != nil {
+		for _, tee := range *tees {
+			if severity <= tee.level && tee.logger.enabled(severity) {
+				return true
+			}
+		}
+	}
+	return l.threshold(c) >= severity && (c.syslog || c.file || c.console || len(c.sinks.outputs) != 0 || base.sink.Load() != nil)
+}
+
+func (l *ULog) RawJSON(severity int, data json.RawMessage) {
+	c := l.view(l.base().current.Load())
+	if c.disabled || l.threshold(c) < severity {
+		return
+	}
+	if data = bytes.TrimSpace(data); len(data) != 0 && data[0] == '{' {
+		var object map[string]json.RawMessage
+
+		if json.Unmarshal(data, &object) == nil {
+			spliced := map[string]any{}
+			for key, value := range c.fields {
+				current, present := object[key]
+				switch {
+				// nested or overriding merges cannot be spliced, the object goes through the structured path
+				case strings.Contains(key, ".") || (present && (c.merge == MERGE_OVERRIDE || string(current) == "null")):
+					var object map[string]any
+
+					if json.Unmarshal(data, &object) == nil {
+						l.log(time.Now(), severity, object)
+						return
+					}
+				case !present:
+					spliced[key] = value
+				case c.merge == MERGE_PREFIX:
+					if _, ok := object["_"+key]; !ok {
+						spliced["_"+key] = value
+					}
+				}
+			}
+			fields := make(map[string]any, len(object)+len(spliced))
+			for key, value := range object {
+				fields[key] = value
+			}
+			for key, value := range spliced {
+				fields[key] = value
+			}
+			l.log(time.Now(), severity, raw{c.splice(data, spliced), fields})
+			return
+		}
+	}
+	l.log(time.Now(), severity, "%s", data)
 }
 
 func (l *ULog) ErrorTime(now time.Time, layout any, a ...any) {
@@ -597,3 +1604,61 @@ func (l *ULog) InfoTime(now time.Time, layout any, a ...any) {
 func (l *ULog) DebugTime(now time.Time, layout any, a ...any) {
 	l.log(now, LOG_DEBUG, layout, a...)
 }
+
+func (l *ULog) ErrorOnce(key string, layout any, a ...any) {
+	if _, seen := l.base().once.LoadOrStore(key, true); !seen {
+		l.log(time.Now(), LOG_ERR, layout, a...)
+	}
+}
+func (l *ULog) WarnOnce(key string, layout any, a ...any) {
+	if _, seen := l.base().once.LoadOrStore(key, true); !seen {
+		l.log(time.Now(), LOG_WARNING, layout, a...)
+	}
+}
+func (l *ULog) InfoOnce(key string, layout any, a ...any) {
+	if _, seen := l.base().once.LoadOrStore(key, true); !seen {
+		l.log(time.Now(), LOG_INFO, layout, a...)
+	}
+}
+func (l *ULog) ResetOnce() {
+	l = l.base()
+	l.once.Range(func(key, _ any) bool {
+		l.once.Delete(key)
+		return true
+	})
+}
+
+func (l *ULog) Writer(severity int) *Writer {
+	return &Writer{logger: l, severity: severity}
+}
+func (w *Writer) Write(data []byte) (int, error) {
+	w.logger.log(time.Now(), w.severity, "%s", bytes.TrimRight(data, "\r\n"))
+	return len(data), nil
+}
+
+func (l *ULog) StdLogger(severity int) *log.Logger {
+	return log.New(l.Writer(severity), "", 0)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(d), 10)), nil
+}
+
+func (b Bytes) String() string {
+	value, units := float64(b), []string{"B", "KB", "MB", "GB", "TB", "PB", "EB"}
+	unit := 0
+	for (value >= 1000 || value <= -1000) && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", int64(b), units[unit])
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + units[unit]
+}
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
@@ -0,0 +1,135 @@
+package ulog
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadWhileLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	logger := New("file(path=" + path + ")")
+	defer logger.Close()
+
+	var group sync.WaitGroup
+	stop := make(chan struct{})
+	for index := 0; index < 8; index++ {
+		group.Add(1)
+		go func(index int) {
+			defer group.Done()
+			child := logger.WithFields(map[string]any{"worker": index})
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				child.Info("message from %d", index)
+				child.Info(map[string]any{"message": "structured", "worker": index})
+			}
+		}(index)
+	}
+	for index := 0; index < 100; index++ {
+		if index%2 == 0 {
+			logger.Load(fmt.Sprintf("file(path=%s) option(level=debug,version=%d)", path, index))
+		} else {
+			logger.SetField("iteration", index)
+		}
+	}
+	close(stop)
+	group.Wait()
+
+	if snapshot := logger.Config(); snapshot.FilePath != path || snapshot.Level != "debug" {
+		t.Fatalf("unexpected configuration after reload: %+v", snapshot)
+	}
+}
+
+func BenchmarkDisabled(b *testing.B) {
+	logger := New("null()")
+	value, fields := any(42), map[string]any{"user": 42}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		logger.Info("disabled %d", value)
+		logger.Debug(fields)
+	}
+}
+
+func TestErrorHandlerReentry(t *testing.T) {
+	logger := New("file(path=/dev/null/ulog/test.log)")
+	defer logger.Close()
+
+	calls := 0
+	logger.SetErrorHandler(func(dest string, err error) {
+		if calls++; calls == 1 {
+			logger.Warn("cannot write to %s: %v", dest, err)
+			logger.Load("file(path=/dev/null/ulog/other.log)")
+			logger.Close()
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		logger.Info("unwritable")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("error handler deadlocked the logger")
+	}
+	if calls != 2 || logger.Errors()["/dev/null/ulog/test.log"] != 2 {
+		t.Fatalf("unexpected error reports: %d calls, %v", calls, logger.Errors())
+	}
+}
+
+func TestSinkReentry(t *testing.T) {
+	logger := New("file(path=" + filepath.Join(t.TempDir(), "test.log") + ")")
+	messages := []string{}
+	logger.SetSink(func(severity int, message string) {
+		if messages = append(messages, message); len(messages) == 1 {
+			logger.Warn("forwarded %q", message)
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		logger.Info("alert")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink deadlocked the logger")
+	}
+	logger.Close()
+	if len(messages) != 2 || messages[0] != "alert" || messages[1] != `forwarded "alert"` {
+		t.Fatalf("unexpected forwarded messages: %q", messages)
+	}
+}
+
+func TestRawJSON(t *testing.T) {
+	logger := New("file(path=" + filepath.Join(t.TempDir(), "test.log") + ")")
+	defer logger.Close()
+
+	message := ""
+	logger.SetSink(func(_ int, value string) {
+		message = value
+	})
+	data := `{"zeta":1,"alpha":{"b":2,"a":1},"n":1.0e2}`
+	logger.RawJSON(LOG_INFO, json.RawMessage(data))
+	if message != data {
+		t.Fatalf("payload not written verbatim: %s", message)
+	}
+	logger.SetField("service", "api")
+	logger.SetField("zeta", "kept")
+	logger.RawJSON(LOG_INFO, json.RawMessage(data))
+	if message != `{"service":"api",`+data[1:] {
+		t.Fatalf("default fields not spliced: %s", message)
+	}
+	logger.RawJSON(LOG_INFO, json.RawMessage(` {} `))
+	if message != `{"service":"api","zeta":"kept"}` {
+		t.Fatalf("default fields not spliced into an empty object: %s", message)
+	}
+}
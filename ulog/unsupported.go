@@ -19,3 +19,11 @@ func (this *Syslog) Info(m string) {
 }
 func (this *Syslog) Warning(m string) {
 }
+func (this *Syslog) Emerg(m string) {
+}
+func (this *Syslog) Alert(m string) {
+}
+func (this *Syslog) Crit(m string) {
+}
+func (this *Syslog) Notice(m string) {
+}
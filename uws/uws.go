@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	crand "crypto/rand"
 	"crypto/sha1"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -16,6 +18,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -30,54 +33,171 @@ import (
 )
 
 const (
-	WEBSOCKET_UUID            = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-	WEBSOCKET_VERSION         = "13"
-	WEBSOCKET_FIN             = 0x80
-	WEBSOCKET_MASK            = 0x80
-	WEBSOCKET_OPCODE_TEXT     = 1
-	WEBSOCKET_OPCODE_BLOB     = 2
-	WEBSOCKET_OPCODE_CLOSE    = 8
-	WEBSOCKET_OPCODE_PING     = 9
-	WEBSOCKET_OPCODE_PONG     = 10
-	WEBSOCKET_ERROR_PROTOCOL  = 1002
-	WEBSOCKET_ERROR_INVALID   = 1007
-	WEBSOCKET_ERROR_OVERSIZED = 1009
+	WEBSOCKET_UUID             = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	WEBSOCKET_VERSION          = "13"
+	WEBSOCKET_FIN              = 0x80
+	WEBSOCKET_MASK             = 0x80
+	WEBSOCKET_RSV              = 0x70
+	WEBSOCKET_OPCODE_TEXT      = 1
+	WEBSOCKET_OPCODE_BLOB      = 2
+	WEBSOCKET_OPCODE_CLOSE     = 8
+	WEBSOCKET_OPCODE_PING      = 9
+	WEBSOCKET_OPCODE_PONG      = 10
+	WEBSOCKET_INVALID_UTF8     = 0x100
+	WEBSOCKET_ERROR_NORMAL     = 1000
+	WEBSOCKET_ERROR_GOINGAWAY  = 1001
+	WEBSOCKET_ERROR_PROTOCOL   = 1002
+	WEBSOCKET_ERROR_INVALID    = 1007
+	WEBSOCKET_ERROR_POLICY     = 1008
+	WEBSOCKET_ERROR_OVERSIZED  = 1009
+	WEBSOCKET_ERROR_UNEXPECTED = 1011
 )
 
+const (
+	WEBSOCKET_CAUSE_NONE = iota
+	WEBSOCKET_CAUSE_LOCAL
+	WEBSOCKET_CAUSE_CLOSE
+	WEBSOCKET_CAUSE_EOF
+	WEBSOCKET_CAUSE_TIMEOUT
+	WEBSOCKET_CAUSE_ERROR
+	WEBSOCKET_CAUSE_PROTOCOL
+)
+
+type RateLimiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
 type Config struct {
-	Proxy           func(*url.URL) (*url.URL, error)
-	TLSConfig       *tls.Config
-	Headers         map[string]string
-	Protocols       []string
-	NeedProtocol    bool
-	ReadSize        int
-	FragmentSize    int
-	MessageSize     int
-	ConnectTimeout  time.Duration
-	ProbeTimeout    int64
-	InactiveTimeout int64
-	WriteTimeout    int64
-	WriteBufferSize int
-	ReadBufferSize  int
-	OpenHandler     func(*Socket)
-	MessageHandler  func(*Socket, int, []byte) bool
-	CloseHandler    func(*Socket, int)
-	Context         any
+	pending                int64
+	Proxy                  func(*url.URL) (*url.URL, error)
+	Network                string
+	Dialer                 *net.Dialer
+	TLSConfig              *tls.Config
+	ClientCert             []byte
+	ClientCertFile         string
+	ClientKey              []byte
+	ClientKeyFile          string
+	RootCAs                []byte
+	RootCAsFile            string
+	Headers                map[string]string
+	Jar                    http.CookieJar
+	Protocols              []string
+	Versions               []string
+	AllowedExtensions      []string
+	FollowRedirects        int
+	NeedProtocol           bool
+	AllowUnmaskedClient    bool
+	LenientUTF8            bool
+	SkipUTF8Validation     bool
+	SkipAcceptVerification bool
+	TCPNoDelay             *bool
+	NoProbe                bool
+	ReadSize               int
+	FragmentSize           int
+	MessageSize            int
+	MaxFragments           int
+	MaxPendingHandshakes   int
+	ReadQueue              int
+	SendQueue              int
+	ConnectTimeout         time.Duration
+	ProbeTimeout           int64
+	InactiveTimeout        int64
+	WriteTimeout           int64
+	MessageAssembleTimeout time.Duration
+	PongTimeout            time.Duration
+	CloseTimeout           time.Duration
+	PingInterval           time.Duration
+	PingPayload            []byte
+	WriteBufferSize        int
+	ReadBufferSize         int
+	OutboundLimiter        RateLimiter
+	CheckOrigin            func(string, *http.Request) bool
+	Authorize              func(*http.Request) (bool, int, []byte)
+	ConnectHandler         func(*Socket, time.Duration)
+	OpenHandler            func(*Socket)
+	MessageHandler         func(*Socket, int, []byte) bool
+	StreamHandler          func(*Socket, int, io.Reader)
+	CloseHandler           func(*Socket, int)
+	PingHandler            func(*Socket, []byte)
+	PongHandler            func(*Socket, []byte)
+	FrameHandler           func(*Socket, bool, byte, int)
+	OnEvent                func(*Socket, string, error)
+	Context                any
 }
 
 type Socket struct {
 	Path, Origin, Agent, Remote, Protocol string
+	Extensions                            []string
 	Context                               any
+	ResponseHeader                        http.Header
+	Request                               *http.Request
 	config                                *Config
 	conn                                  net.Conn
-	connected, client, closing            bool
-	wlock, dlock, clock                   sync.Mutex
+	connected, client, closing, csent     bool
+	cwritten                              bool
+	cause                                 int
+	wlock, dlock                          plock
+	clock, mlock                          sync.Mutex
+	masks                                 []byte
+	moffset                               int
 	slast, rlast                          int64
+	rsize, msize, fmax                    atomic.Int64
+	probe, rtt, lprobe, csince            atomic.Int64
+	bsent, breceived, msent, mreceived    atomic.Int64
+	done                                  chan struct{}
+	stop                                  chan struct{}
+	queue                                 chan message
+	squeue, uqueue                        chan net.Buffers
+	sidle                                 chan struct{}
+	spending                              atomic.Int64
+}
+
+type message struct {
+	mode int
+	data []byte
+}
+
+type writer struct {
+	socket *Socket
+	mode   byte
+	buffer []byte
+	closed bool
+}
+
+type plock struct {
+	lock             sync.Mutex
+	cond             *sync.Cond
+	busy             bool
+	tickets, serving [2]uint64
+	abandoned        [2]map[uint64]bool
+}
+
+type UpgradeError struct {
+	Status int
+	Body   []byte
+}
+
+type Hub struct {
+	sockets map[*Socket]bool
+	sync.Mutex
+}
+
+type Server struct {
+	pending int64
+	config  *Config
+	sockets map[*Socket]bool
+	sync.Mutex
 }
 
 var (
-	proxy func(*url.URL) (*url.URL, error)
-	now   int64
+	proxy  func(*url.URL) (*url.URL, error)
+	now    int64
+	epoch  = time.Now()
+	keygen = uuid.BUUID
+	// extensions rewriting frames or payloads, uws implements none of them so they are never negotiated
+	framing = map[string]bool{"permessage-deflate": true, "perframe-deflate": true, "deflate-frame": true, "x-webkit-deflate-frame": true}
+
+	ErrReadTimeout = errors.New(`websocket: read timeout`)
 )
 
 func init() {
@@ -92,17 +212,47 @@ func init() {
 }
 
 func Dial(endpoint, origin string, config *Config) (ws *Socket, err error) {
+	return DialContext(context.Background(), endpoint, origin, config)
+}
+
+func DialContext(ctx context.Context, endpoint, origin string, config *Config) (ws *Socket, err error) {
+	if ws, err = dial(ctx, nil, endpoint, origin, config, 0); err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return
+}
+
+func Upgrade(conn net.Conn, endpoint, origin string, config *Config) (ws *Socket, err error) {
+	if conn == nil {
+		return nil, errors.New(`websocket: nil connection`)
+	}
+	return dial(context.Background(), conn, endpoint, origin, config, 0)
+}
+
+func dial(ctx context.Context, existing net.Conn, endpoint, origin string, config *Config, redirects int) (ws *Socket, err error) {
 	if config == nil {
 		config = &Config{}
 	}
+	if config.OnEvent != nil {
+		config.OnEvent(nil, "handshake-start", nil)
+		defer func() {
+			if err != nil {
+				config.OnEvent(nil, "handshake-error", err)
+			}
+		}()
+	}
+	// normalized on a per-dial copy, the caller's config may be shared by concurrent dials
+	normalized := *config
+	config = &normalized
 	if config.Proxy == nil {
 		config.Proxy = proxy
 	}
 	config.ReadSize = cval(config.ReadSize, 4<<10, 4<<10, 256<<10)
 	config.FragmentSize = cval(config.FragmentSize, 16<<10, 4<<10, 1<<20)
 	config.MessageSize = cval(config.MessageSize, 4<<20, 4<<10, 64<<20)
-	config.ConnectTimeout = time.Duration(cval(int(config.ProbeTimeout), int(10*time.Second), int(1*time.Second), int(30*time.Second)))
+	config.ConnectTimeout = time.Duration(cval(int(config.ConnectTimeout), int(10*time.Second), int(1*time.Second), int(30*time.Second)))
 	config.ProbeTimeout = int64(cval(int(config.ProbeTimeout), int(15*time.Second), int(1*time.Second), int(30*time.Second)))
+	config.CloseTimeout = time.Duration(cval(int(config.CloseTimeout), int(5*time.Second), int(100*time.Millisecond), int(30*time.Second)))
 	config.InactiveTimeout = int64(cval(int(config.InactiveTimeout), int(3*config.ProbeTimeout), int(config.ProbeTimeout+int64(time.Second)), int(5*config.ProbeTimeout)))
 	config.WriteTimeout = int64(cval(int(config.WriteTimeout), int(10*time.Second), int(1*time.Second), int(30*time.Second)))
 	if config.ReadBufferSize != 0 {
@@ -111,11 +261,57 @@ func Dial(endpoint, origin string, config *Config) (ws *Socket, err error) {
 	if config.WriteBufferSize != 0 {
 		config.WriteBufferSize = cval(config.WriteBufferSize, 4<<10, 4<<10, 32<<20)
 	}
+	if len(config.PingPayload) > 125 {
+		config.PingPayload = config.PingPayload[:125]
+	}
+	// built on every dial so rotated certificate files are picked up
+	tconfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tconfig = config.TLSConfig.Clone()
+	} else if config.ClientCert != nil || config.ClientCertFile != "" || config.RootCAs != nil || config.RootCAsFile != "" {
+		if certificate, err := pemdata(config.ClientCert, config.ClientCertFile); err != nil {
+			return nil, err
+		} else if certificate != nil {
+			key, err := pemdata(config.ClientKey, config.ClientKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if key == nil {
+				key = certificate
+			}
+			pair, err := tls.X509KeyPair(certificate, key)
+			if err != nil {
+				return nil, fmt.Errorf(`websocket: %v`, err)
+			}
+			tconfig.Certificates = []tls.Certificate{pair}
+		}
+		if authorities, err := pemdata(config.RootCAs, config.RootCAsFile); err != nil {
+			return nil, err
+		} else if authorities != nil {
+			tconfig.RootCAs = x509.NewCertPool()
+			if !tconfig.RootCAs.AppendCertsFromPEM(authorities) {
+				return nil, errors.New(`websocket: no valid certificate in RootCAs`)
+			}
+		}
+	}
+	socket := ""
+	if index := strings.Index(endpoint, "+unix://"); index >= 0 && (endpoint[:index] == "ws" || endpoint[:index] == "wss") {
+		// ws+unix:///run/agent.sock:/path, the request path follows the socket path after a colon
+		socket = endpoint[index+8:]
+		path := "/"
+		if position := strings.Index(socket, ":"); position >= 0 {
+			socket, path = socket[:position], socket[position+1:]
+		}
+		endpoint = endpoint[:index] + "://localhost" + path
+	}
 	endpoint = strings.Replace(strings.Replace(endpoint, "ws:", "http:", 1), "wss:", "https:", 1)
 	if url, err := url.Parse(endpoint); err == nil {
 		proxy, _ := config.Proxy(url)
+		if socket != "" {
+			proxy = nil
+		}
 		if request, err := http.NewRequest("GET", endpoint, nil); err == nil {
-			nonce := base64.StdEncoding.EncodeToString(uuid.BUUID())
+			nonce := base64.StdEncoding.EncodeToString(keygen())
 			request.Header.Add("User-Agent", "uws")
 			request.Header.Add("Connection", "Upgrade")
 			request.Header.Add("Upgrade", "websocket")
@@ -127,115 +323,212 @@ func Dial(endpoint, origin string, config *Config) (ws *Socket, err error) {
 			if origin != "" {
 				request.Header.Add("Origin", origin)
 			}
+			if config.Jar != nil {
+				for _, cookie := range config.Jar.Cookies(url) {
+					request.AddCookie(cookie)
+				}
+			}
+			// caller headers replace the defaults, an empty value drops the header (an empty User-Agent stops net/http adding its own)
 			for name, value := range config.Headers {
-				request.Header.Add(name, value)
+				if value == "" && !strings.EqualFold(name, "User-Agent") {
+					request.Header.Del(name)
+				} else if strings.EqualFold(name, "Host") {
+					request.Host = value
+				} else {
+					request.Header.Set(name, value)
+				}
 			}
 
 			start, scheme, address := time.Now(), url.Scheme, url.Host
+			network := config.Network
+			if network != "tcp4" && network != "tcp6" {
+				network = "tcp"
+			}
+			if socket != "" {
+				network, address = "unix", socket
+			}
 			if proxy != nil {
 				scheme, address = proxy.Scheme, proxy.Host
 			}
-			ctx, cancel := context.WithTimeout(context.Background(), config.ConnectTimeout)
+			ctx, cancel := context.WithTimeout(ctx, config.ConnectTimeout)
 			defer cancel()
-			if conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address); err == nil {
-				if tconn, ok := conn.(*net.TCPConn); ok {
-					if config.ReadBufferSize != 0 {
-						tconn.SetReadBuffer(config.ReadBufferSize)
-					}
-					if config.WriteBufferSize != 0 {
-						tconn.SetWriteBuffer(config.WriteBufferSize)
-					}
-				}
-				if scheme == "https" {
-					if config.TLSConfig == nil {
-						config.TLSConfig = &tls.Config{}
-					}
-					config.TLSConfig.ServerName = address
-					if value, _, err := net.SplitHostPort(address); err == nil {
-						config.TLSConfig.ServerName = value
+			dialer := config.Dialer
+			if dialer == nil {
+				dialer = &net.Dialer{}
+			}
+			conn := existing
+			if conn == nil {
+				conn, err = dialer.DialContext(ctx, network, address)
+			}
+			if err == nil {
+				stop, exited, raw := make(chan struct{}), make(chan struct{}), conn
+				go func() {
+					select {
+					case <-ctx.Done():
+						raw.SetDeadline(time.Unix(1, 0))
+					case <-stop:
 					}
-					conn = tls.Client(conn, config.TLSConfig)
-					if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
-						conn.Close()
-						return nil, fmt.Errorf(`websocket: %v`, err)
+					close(exited)
+				}()
+				release := func() {
+					if stop != nil {
+						close(stop)
+						<-exited
+						stop = nil
 					}
 				}
-				if proxy != nil {
-					host, port := url.Host, "0"
-					if value1, value2, err := net.SplitHostPort(host); err == nil {
-						host, port = value1, value2
-					}
-					if port == "0" {
-						if url.Scheme == "https" {
-							port = "443"
-						} else {
-							port = "80"
+				defer release()
+				deadline, _ := ctx.Deadline()
+				if existing == nil {
+					if tconn, ok := conn.(*net.TCPConn); ok {
+						if config.ReadBufferSize != 0 {
+							tconn.SetReadBuffer(config.ReadBufferSize)
+						}
+						if config.WriteBufferSize != 0 {
+							tconn.SetWriteBuffer(config.WriteBufferSize)
+						}
+						if config.TCPNoDelay != nil {
+							tconn.SetNoDelay(*config.TCPNoDelay)
 						}
 					}
-					payload := fmt.Sprintf("CONNECT %s:%s HTTP/1.1\r\nHost: %s:%s\r\n", host, port, host, port)
-					if user := proxy.User; user != nil {
-						password, _ := user.Password()
-						payload += fmt.Sprintf("Proxy-Authorization: basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
-					}
-					payload += "\r\n"
-
-					conn.SetWriteDeadline(time.Now().Add(config.ConnectTimeout - time.Since(start)))
-					if _, err := conn.Write([]byte(payload)); err != nil {
-						conn.Close()
-						return nil, fmt.Errorf(`websocket: %v`, err)
-					}
-					conn.SetReadDeadline(time.Now().Add(config.ConnectTimeout))
-					if response, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
-						response.Body.Close()
-						if response.StatusCode != 200 {
+					if scheme == "https" {
+						tconfig.ServerName = address
+						if socket != "" {
+							tconfig.ServerName = request.Host
+						}
+						if value, _, err := net.SplitHostPort(tconfig.ServerName); err == nil {
+							tconfig.ServerName = value
+						}
+						conn = tls.Client(conn, tconfig)
+						if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
 							conn.Close()
-							return nil, fmt.Errorf(`websocket: proxy connection error`)
+							return nil, fmt.Errorf(`websocket: %v`, err)
 						}
-					} else {
-						conn.Close()
-						return nil, fmt.Errorf(`websocket: %v`, err)
 					}
+					if proxy != nil {
+						host, port := url.Host, "0"
+						if value1, value2, err := net.SplitHostPort(host); err == nil {
+							host, port = value1, value2
+						}
+						if port == "0" {
+							if url.Scheme == "https" {
+								port = "443"
+							} else {
+								port = "80"
+							}
+						}
+						payload := fmt.Sprintf("CONNECT %s:%s HTTP/1.1\r\nHost: %s:%s\r\n", host, port, host, port)
+						if user := proxy.User; user != nil {
+							password, _ := user.Password()
+							payload += fmt.Sprintf("Proxy-Authorization: basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+						}
+						payload += "\r\n"
 
-					if url.Scheme == "https" {
-						if config.TLSConfig == nil {
-							config.TLSConfig = &tls.Config{}
+						conn.SetWriteDeadline(deadline)
+						if _, err := conn.Write([]byte(payload)); err != nil {
+							conn.Close()
+							return nil, fmt.Errorf(`websocket: %v`, err)
 						}
-						config.TLSConfig.ServerName = host
-						conn = tls.Client(conn, config.TLSConfig)
-						if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
+						conn.SetReadDeadline(deadline)
+						if response, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+							response.Body.Close()
+							if response.StatusCode != 200 {
+								conn.Close()
+								return nil, fmt.Errorf(`websocket: proxy connection error`)
+							}
+						} else {
 							conn.Close()
 							return nil, fmt.Errorf(`websocket: %v`, err)
 						}
+
+						if url.Scheme == "https" {
+							tconfig.ServerName = host
+							conn = tls.Client(conn, tconfig)
+							if err := conn.(*tls.Conn).HandshakeContext(ctx); err != nil {
+								conn.Close()
+								return nil, fmt.Errorf(`websocket: %v`, err)
+							}
+						}
 					}
 				}
 
-				conn.SetWriteDeadline(time.Now().Add(config.ConnectTimeout - time.Since(start)))
+				conn.SetWriteDeadline(deadline)
 				if err := request.Write(conn); err != nil {
 					conn.Close()
 					return nil, fmt.Errorf(`websocket: %v`, err)
 				}
-				conn.SetReadDeadline(time.Now().Add(config.ConnectTimeout))
-				if response, err := http.ReadResponse(bufio.NewReader(conn), request); err == nil {
+				conn.SetReadDeadline(deadline)
+				reader := bufio.NewReader(conn)
+				if response, err := http.ReadResponse(reader, request); err == nil {
+					if cookies := response.Cookies(); config.Jar != nil && len(cookies) != 0 {
+						config.Jar.SetCookies(url, cookies)
+					}
 					skey, _ := base64.StdEncoding.DecodeString(response.Header.Get("Sec-WebSocket-Accept"))
 					ckey, path := sha1.Sum([]byte(nonce+WEBSOCKET_UUID)), url.Path
 					if path == "" {
 						path = "/"
 					}
+					accept := bytes.Equal(ckey[:], skey)
+					if !accept && config.SkipAcceptVerification {
+						if config.OnEvent != nil {
+							config.OnEvent(nil, "accept-mismatch", fmt.Errorf(`websocket: skipping invalid Sec-WebSocket-Accept from %s`, url.Host))
+						}
+						accept = true
+					}
 					if response.StatusCode != http.StatusSwitchingProtocols || strings.ToLower(response.Header.Get("Connection")) != "upgrade" ||
-						strings.ToLower(response.Header.Get("Upgrade")) != "websocket" || !bytes.Equal(ckey[:], skey) {
+						strings.ToLower(response.Header.Get("Upgrade")) != "websocket" || !accept {
+						location := response.Header.Get("Location")
+						if response.StatusCode/100 == 3 && location != "" && existing == nil && redirects < config.FollowRedirects {
+							response.Body.Close()
+							conn.Close()
+							release()
+							if target, err := url.Parse(location); err == nil {
+								return dial(ctx, nil, target.String(), origin, config, redirects+1)
+							}
+							return nil, fmt.Errorf(`websocket: invalid redirect location "%s"`, location)
+						}
+						body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
 						response.Body.Close()
 						conn.Close()
-						return nil, fmt.Errorf(`websocket: invalid protocol upgrade (status %d)`, response.StatusCode)
+						return nil, &UpgradeError{Status: response.StatusCode, Body: body}
 					}
 					protocol := response.Header.Get("Sec-WebSocket-Protocol")
+					if protocol != "" {
+						if list := protocols(protocol); len(list) != 1 || match(list, config.Protocols) == "" {
+							response.Body.Close()
+							conn.Close()
+							return nil, fmt.Errorf(`websocket: server selected an unoffered sub-protocol "%s"`, protocol)
+						}
+					}
 					if len(config.Protocols) > 0 && protocol == "" && config.NeedProtocol {
 						response.Body.Close()
 						conn.Close()
 						return nil, errors.New(`websocket: could not negotiate sub-protocol with server`)
 					}
-					ws = &Socket{Path: path, Remote: conn.RemoteAddr().String(), Origin: origin, Protocol: protocol, Context: config.Context,
-						config: config, client: true, conn: conn, connected: true}
-					go ws.receive(nil)
+					if release(); ctx.Err() != nil {
+						conn.Close()
+						return nil, ctx.Err()
+					}
+					conn.SetDeadline(time.Time{})
+					negotiated, _ := extensions(strings.Join(response.Header.Values("Sec-WebSocket-Extensions"), ","))
+					ws = &Socket{Path: path, Remote: conn.RemoteAddr().String(), Origin: origin, Protocol: protocol, Extensions: negotiated, Context: config.Context,
+						ResponseHeader: response.Header, config: config, client: true, conn: conn, connected: true, done: make(chan struct{}), stop: make(chan struct{})}
+					if config.ReadQueue > 0 {
+						ws.queue = make(chan message, config.ReadQueue)
+					}
+					if config.SendQueue > 0 {
+						ws.squeue, ws.uqueue, ws.sidle = make(chan net.Buffers, config.SendQueue), make(chan net.Buffers, config.SendQueue), make(chan struct{}, 1)
+						go ws.flush()
+					}
+					if reader.Buffered() != 0 {
+						go ws.receive(reader)
+					} else {
+						go ws.receive(nil)
+					}
+					ws.event("handshake-done", nil)
+					if config.ConnectHandler != nil {
+						config.ConnectHandler(ws, time.Since(start))
+					}
 					if config.OpenHandler != nil {
 						config.OpenHandler(ws)
 					}
@@ -256,37 +549,80 @@ func Dial(endpoint, origin string, config *Config) (ws *Socket, err error) {
 }
 
 func Handle(response http.ResponseWriter, request *http.Request, config *Config) (handled bool, ws *Socket) {
+	if config == nil {
+		config = &Config{}
+	}
+	return handle(response, request, config, &config.pending)
+}
+
+// pending is kept apart from config, which servers hold as a private copy
+func handle(response http.ResponseWriter, request *http.Request, config *Config, pending *int64) (handled bool, ws *Socket) {
 	if strings.Contains(strings.ToLower(request.Header.Get("Connection")), "upgrade") && strings.ToLower(request.Header.Get("Upgrade")) == "websocket" {
 		handled = true
+		if config.OnEvent != nil {
+			config.OnEvent(nil, "handshake-start", nil)
+			defer func() {
+				if ws == nil {
+					config.OnEvent(nil, "handshake-error", fmt.Errorf(`websocket: handshake from %s rejected`, request.RemoteAddr))
+				}
+			}()
+		}
+		release := func() {}
+		if config.MaxPendingHandshakes > 0 {
+			if atomic.AddInt64(pending, 1) > int64(config.MaxPendingHandshakes) {
+				atomic.AddInt64(pending, -1)
+				response.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var once sync.Once
+			release = func() {
+				once.Do(func() {
+					atomic.AddInt64(pending, -1)
+				})
+			}
+			defer release()
+		}
 		if request.Method != http.MethodGet {
 			response.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
+		versions, version := config.Versions, false
+		if len(versions) == 0 {
+			versions = []string{WEBSOCKET_VERSION}
+		}
+		for _, value := range versions {
+			if request.Header.Get("Sec-WebSocket-Version") == value {
+				version = true
+				break
+			}
+		}
 		ckey := request.Header.Get("Sec-WebSocket-Key")
-		if request.Header.Get("Sec-WebSocket-Version") != WEBSOCKET_VERSION || ckey == "" {
-			response.Header().Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+		if !version || ckey == "" {
+			response.Header().Set("Sec-WebSocket-Version", strings.Join(versions, ", "))
 			response.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if config.CheckOrigin != nil && !config.CheckOrigin(request.Header.Get("Origin"), request) {
+			response.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if config.Authorize != nil {
+			if ok, status, body := config.Authorize(request); !ok {
+				if status == 0 {
+					status = http.StatusForbidden
+				}
+				response.WriteHeader(status)
+				response.Write(body)
+				return
+			}
+		}
 		if _, ok := response.(http.Hijacker); !ok {
 			response.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		cprotocols, sprotocols, protocol := []string{}, map[string]bool{}, ""
+		protocol := ""
 		if len(config.Protocols) > 0 {
-			if splitter := rcache.Get("[, ]+"); splitter != nil {
-				cprotocols = splitter.Split(request.Header.Get("Sec-WebSocket-Protocol"), 10)
-			}
-			if len(cprotocols) > 0 {
-				for _, value := range config.Protocols {
-					sprotocols[value] = true
-				}
-				for _, value := range cprotocols {
-					if sprotocols[value] {
-						protocol = value
-					}
-				}
-			}
+			protocol = match(protocols(request.Header.Get("Sec-WebSocket-Protocol")), config.Protocols)
 			if protocol != "" {
 				response.Header().Set("Sec-WebSocket-Protocol", protocol)
 			} else if config.NeedProtocol {
@@ -294,20 +630,49 @@ func Handle(response http.ResponseWriter, request *http.Request, config *Config)
 				return
 			}
 		}
+		offered, valid := extensions(strings.Join(request.Header.Values("Sec-WebSocket-Extensions"), ","))
+		if !valid {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// allowed extensions are passed through to the application, which must not expect uws to alter framing
+		accepted := []string{}
+	negotiate:
+		for _, extension := range offered {
+			if framing[extension] {
+				continue
+			}
+			for _, value := range accepted {
+				if value == extension {
+					continue negotiate
+				}
+			}
+			for _, value := range config.AllowedExtensions {
+				if strings.EqualFold(value, extension) {
+					accepted = append(accepted, extension)
+					break
+				}
+			}
+		}
+		if len(accepted) != 0 {
+			response.Header().Set("Sec-WebSocket-Extensions", strings.Join(accepted, ", "))
+		}
 		skey := sha1.Sum([]byte(ckey + WEBSOCKET_UUID))
 		response.Header().Set("Connection", "Upgrade")
 		response.Header().Set("Upgrade", "websocket")
 		response.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(skey[:]))
 		response.WriteHeader(http.StatusSwitchingProtocols)
+		start := time.Now()
 		if conn, reader, err := response.(http.Hijacker).Hijack(); err == nil {
 			conn.SetDeadline(time.Time{})
-			if config == nil {
-				config = &Config{}
-			}
+			// normalized on a per-socket copy, the caller's config is shared by concurrent handshakes
+			normalized := *config
+			config = &normalized
 			config.ReadSize = cval(config.ReadSize, 4<<10, 4<<10, 256<<10)
 			config.FragmentSize = cval(config.FragmentSize, 16<<10, 4<<10, 1<<20)
 			config.MessageSize = cval(config.MessageSize, 4<<20, 4<<10, 64<<20)
 			config.ProbeTimeout = int64(cval(int(config.ProbeTimeout), int(10*time.Second), int(1*time.Second), int(30*time.Second)))
+			config.CloseTimeout = time.Duration(cval(int(config.CloseTimeout), int(5*time.Second), int(100*time.Millisecond), int(30*time.Second)))
 			config.InactiveTimeout = int64(cval(int(config.InactiveTimeout), int(3*config.ProbeTimeout), int(config.ProbeTimeout+int64(time.Second)), int(5*config.ProbeTimeout)))
 			config.WriteTimeout = int64(cval(int(config.WriteTimeout), int(10*time.Second), int(1*time.Second), int(30*time.Second)))
 			if config.ReadBufferSize != 0 {
@@ -316,6 +681,9 @@ func Handle(response http.ResponseWriter, request *http.Request, config *Config)
 			if config.WriteBufferSize != 0 {
 				config.WriteBufferSize = cval(config.WriteBufferSize, 4<<10, 4<<10, 32<<20)
 			}
+			if len(config.PingPayload) > 125 {
+				config.PingPayload = config.PingPayload[:125]
+			}
 			if tconn, ok := conn.(*net.TCPConn); ok {
 				if config.ReadBufferSize != 0 {
 					tconn.SetReadBuffer(config.ReadBufferSize)
@@ -323,14 +691,30 @@ func Handle(response http.ResponseWriter, request *http.Request, config *Config)
 				if config.WriteBufferSize != 0 {
 					tconn.SetWriteBuffer(config.WriteBufferSize)
 				}
+				if config.TCPNoDelay != nil {
+					tconn.SetNoDelay(*config.TCPNoDelay)
+				}
 			}
 			origin := request.Header.Get("Origin")
 			if strings.ToLower(origin) == "null" {
 				origin = ""
 			}
-			ws = &Socket{Path: request.URL.Path, Origin: origin, Agent: request.Header.Get("User-Agent"),
-				Remote: conn.RemoteAddr().String(), Protocol: protocol, Context: config.Context, config: config, conn: conn, connected: true}
+			ws = &Socket{Path: request.URL.Path, Origin: origin, Agent: request.Header.Get("User-Agent"), Request: request,
+				Remote: conn.RemoteAddr().String(), Protocol: protocol, Extensions: accepted, Context: config.Context, config: config, conn: conn, connected: true, done: make(chan struct{}), stop: make(chan struct{})}
+			if config.ReadQueue > 0 {
+				ws.queue = make(chan message, config.ReadQueue)
+			}
+			if config.SendQueue > 0 {
+				ws.squeue, ws.uqueue, ws.sidle = make(chan net.Buffers, config.SendQueue), make(chan net.Buffers, config.SendQueue), make(chan struct{}, 1)
+				go ws.flush()
+			}
 			go ws.receive(reader)
+			// the handshake is over, long-running handlers must not hold a pending slot
+			release()
+			ws.event("handshake-done", nil)
+			if config.ConnectHandler != nil {
+				config.ConnectHandler(ws, time.Since(start))
+			}
 			if config.OpenHandler != nil {
 				config.OpenHandler(ws)
 			}
@@ -340,6 +724,142 @@ func Handle(response http.ResponseWriter, request *http.Request, config *Config)
 	return
 }
 
+func (c *Config) PendingHandshakes() int {
+	return int(atomic.LoadInt64(&c.pending))
+}
+
+func NewServer(config *Config) *Server {
+	if config == nil {
+		config = &Config{}
+	}
+	s := &Server{config: &Config{}, sockets: map[*Socket]bool{}}
+	*s.config = *config
+	opened, closed := config.OpenHandler, config.CloseHandler
+	s.config.OpenHandler = func(ws *Socket) {
+		s.Lock()
+		s.sockets[ws] = true
+		s.Unlock()
+		if opened != nil {
+			opened(ws)
+		}
+	}
+	s.config.CloseHandler = func(ws *Socket, code int) {
+		s.Lock()
+		delete(s.sockets, ws)
+		s.Unlock()
+		if closed != nil {
+			closed(ws, code)
+		}
+	}
+	return s
+}
+
+func (s *Server) Handle(response http.ResponseWriter, request *http.Request) (handled bool, ws *Socket) {
+	return handle(response, request, s.config, &s.pending)
+}
+
+func (s *Server) PendingHandshakes() int {
+	return int(atomic.LoadInt64(&s.pending))
+}
+
+func (s *Server) Count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sockets)
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Lock()
+	sockets := make([]*Socket, 0, len(s.sockets))
+	for ws := range s.sockets {
+		sockets = append(sockets, ws)
+	}
+	s.Unlock()
+	return shutdown(ctx, sockets, nil)
+}
+
+func (h *Hub) Add(ws *Socket) {
+	h.Lock()
+	if h.sockets == nil {
+		h.sockets = map[*Socket]bool{}
+	}
+	h.sockets[ws] = true
+	h.Unlock()
+}
+
+func (h *Hub) Remove(ws *Socket) {
+	h.Lock()
+	delete(h.sockets, ws)
+	h.Unlock()
+}
+
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.Lock()
+	sockets := make([]*Socket, 0, len(h.sockets))
+	for ws := range h.sockets {
+		sockets = append(sockets, ws)
+	}
+	h.Unlock()
+	return shutdown(ctx, sockets, h.Remove)
+}
+
+func (h *Hub) Count() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.sockets)
+}
+
+// server sockets share a single pre-built frame, client sockets need their own masked copy
+func (h *Hub) Broadcast(mode byte, data []byte) {
+	var frame []byte
+
+	h.Lock()
+	sockets := make([]*Socket, 0, len(h.sockets))
+	for ws := range h.sockets {
+		sockets = append(sockets, ws)
+	}
+	h.Unlock()
+	for _, ws := range sockets {
+		var err error
+
+		if ws.client {
+			err = ws.Write(mode, data)
+		} else {
+			if frame == nil {
+				frame = BuildServerFrame(mode, data)
+			}
+			err = ws.WriteFrame(frame)
+		}
+		if err != nil {
+			h.Remove(ws)
+		}
+	}
+}
+
+func shutdown(ctx context.Context, sockets []*Socket, closed func(*Socket)) error {
+	for _, ws := range sockets {
+		ws.CloseReason(WEBSOCKET_ERROR_GOINGAWAY, "server shutdown")
+	}
+	for _, ws := range sockets {
+		select {
+		case <-ws.done:
+			if closed != nil {
+				closed(ws)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (e *UpgradeError) Error() string {
+	if body := strings.TrimSpace(string(e.Body)); body != "" {
+		return fmt.Sprintf(`websocket: invalid protocol upgrade (status %d): %s`, e.Status, body)
+	}
+	return fmt.Sprintf(`websocket: invalid protocol upgrade (status %d)`, e.Status)
+}
+
 func (s *Socket) IsClient() bool {
 	return s.client
 }
@@ -348,17 +868,202 @@ func (s *Socket) IsConnected() bool {
 	return s.connected
 }
 
+func (s *Socket) MaxFragmentSeen() int {
+	return int(s.fmax.Load())
+}
+
+func (s *Socket) BytesSent() int64 {
+	return s.bsent.Load()
+}
+
+func (s *Socket) BytesReceived() int64 {
+	return s.breceived.Load()
+}
+
+func (s *Socket) MessagesSent() int64 {
+	return s.msent.Load()
+}
+
+func (s *Socket) MessagesReceived() int64 {
+	return s.mreceived.Load()
+}
+
+func (s *Socket) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Socket) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Socket) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+func (s *Socket) LastProbe() time.Time {
+	if value := s.lprobe.Load(); value != 0 {
+		return time.Unix(0, value)
+	}
+	return time.Time{}
+}
+
+func (s *Socket) SetReadSize(size int) {
+	s.rsize.Store(int64(cval(size, 4<<10, 4<<10, 256<<10)))
+}
+
+// applies from the next message, a message being reassembled keeps the previous limit
+func (s *Socket) SetMessageSize(size int) {
+	s.msize.Store(int64(cval(size, 4<<20, 4<<10, 64<<20)))
+}
+
 func (s *Socket) Write(mode byte, data []byte) (err error) {
-	var mask []byte
+	s.dlock.acquire(false)
+	defer s.dlock.release()
+	return s.write(context.Background(), s.squeue, mode, data)
+}
+
+func (s *Socket) WriteText(data []byte) (err error) {
+	if !utf8.Valid(data) {
+		return errors.New(`websocket: invalid UTF-8 text`)
+	}
+	return s.Write(WEBSOCKET_OPCODE_TEXT, data)
+}
+
+func (s *Socket) WriteBinary(data []byte) (err error) {
+	return s.Write(WEBSOCKET_OPCODE_BLOB, data)
+}
+
+func (s *Socket) WriteString(value string) (err error) {
+	if !utf8.ValidString(value) {
+		return errors.New(`websocket: invalid UTF-8 text`)
+	}
+	// client frames are masked in place, so only server sockets can send straight from the string memory
+	if s.client || value == "" {
+		return s.Write(WEBSOCKET_OPCODE_TEXT, []byte(value))
+	}
+	return s.Write(WEBSOCKET_OPCODE_TEXT, unsafe.Slice(unsafe.StringData(value), len(value)))
+}
 
+// ctx also bounds the wait behind other writers; once frames are on the wire a cancellation closes the socket
+// (1011 between fragments, a plain close mid-frame) as the message can no longer be completed
+func (s *Socket) WriteContext(ctx context.Context, mode byte, data []byte) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = s.dlock.acquireContext(ctx, false); err != nil {
+		return
+	}
+	defer s.dlock.release()
+	if ctx.Done() != nil {
+		stop, exited := make(chan struct{}), make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.conn.SetWriteDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+			close(exited)
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+			s.wlock.acquire(true)
+			s.slast = 0
+			s.wlock.release()
+		}()
+	}
+	if err = s.write(ctx, s.squeue, mode, data); err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return
+}
+
+func (s *Socket) WriteUrgent(mode byte, data []byte) (err error) {
+	s.dlock.acquire(true)
+	defer s.dlock.release()
+	return s.write(context.Background(), s.uqueue, mode, data)
+}
+
+func (s *Socket) BatchWrite(batch func(write func(mode byte, data []byte) error) error) (err error) {
+	s.dlock.acquire(false)
+	defer s.dlock.release()
+	return batch(func(mode byte, data []byte) error {
+		return s.write(context.Background(), s.squeue, mode, data)
+	})
+}
+
+// the frame is written as-is, bypassing fragmentation
+func (s *Socket) WriteFrame(frame []byte) (err error) {
+	if len(frame) < 2 || s.client != (frame[1]&WEBSOCKET_MASK != 0) {
+		return errors.New(`websocket: invalid frame`)
+	}
+	size, offset := int(frame[1]&0x7f), 2
+	if size == 126 && len(frame) >= 4 {
+		size, offset = int(binary.BigEndian.Uint16(frame[2:])), 4
+	} else if size == 127 && len(frame) >= 10 {
+		size, offset = int(binary.BigEndian.Uint64(frame[2:])), 10
+	}
+	if s.client {
+		offset += 4
+	}
+	if size < 0 || len(frame) != offset+size {
+		return errors.New(`websocket: invalid frame`)
+	}
+	s.dlock.acquire(false)
+	defer s.dlock.release()
+	s.clock.Lock()
+	closing := s.csent
+	s.clock.Unlock()
+	if closing {
+		return errors.New(`websocket: closing`)
+	}
+	if s.squeue != nil {
+		s.spending.Add(1)
+		select {
+		case s.squeue <- net.Buffers{frame}:
+		default:
+			s.spending.Add(-1)
+			return errors.New(`websocket: send queue full`)
+		}
+	} else if err = s.send(net.Buffers{frame}); err != nil {
+		return
+	}
+	s.count(frame[0], size)
+	return
+}
+
+func BuildServerFrame(mode byte, data []byte) []byte {
+	size := len(data)
+	frame := make([]byte, 0, size+10)
+	if size < 126 {
+		frame = append(frame, WEBSOCKET_FIN|mode, byte(size))
+	} else if size < 65536 {
+		frame = append(frame, WEBSOCKET_FIN|mode, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(size))
+	} else {
+		frame = append(frame, WEBSOCKET_FIN|mode, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(size))
+	}
+	return append(frame, data...)
+}
+
+// queue is the send lane (nil when writing synchronously), urgent messages use their own lane flushed first
+func (s *Socket) write(ctx context.Context, queue chan net.Buffers, mode byte, data []byte) (err error) {
+	s.clock.Lock()
+	closing := s.csent
+	s.clock.Unlock()
+	if closing {
+		return errors.New(`websocket: closing`)
+	}
 	length := len(data)
 	if (mode == WEBSOCKET_OPCODE_TEXT || mode == WEBSOCKET_OPCODE_BLOB) && length > 0 {
-		s.dlock.Lock()
-		defer s.dlock.Unlock()
 		frames := length / s.config.FragmentSize
 		if length%s.config.FragmentSize != 0 {
 			frames++
 		}
+		if queue != nil && cap(queue)-len(queue) < frames {
+			return errors.New(`websocket: send queue full`)
+		}
 		for frame := 1; frame <= frames; frame++ {
 			fin, offset, size := byte(0), (frame-1)*s.config.FragmentSize, s.config.FragmentSize
 			if frame == frames {
@@ -366,99 +1071,464 @@ func (s *Socket) Write(mode byte, data []byte) (err error) {
 			}
 			if frame > 1 {
 				mode = 0
+				if ctx.Err() != nil {
+					s.Close(WEBSOCKET_ERROR_UNEXPECTED)
+					return ctx.Err()
+				}
 			}
-			payload := net.Buffers{[]byte{fin | mode, 0}}
-			if size < 126 {
-				payload[0][1] |= byte(size)
-			} else if size < 65536 {
-				payload[0][1] |= 126
-				payload = append(payload, []byte{0, 0})
-				binary.BigEndian.PutUint16(payload[1], uint16(size))
-			} else {
-				payload[0][1] |= 127
-				payload = append(payload, []byte{0, 0, 0, 0, 0, 0, 0, 0})
-				binary.BigEndian.PutUint64(payload[1], uint64(size))
+			if err = s.fragment(ctx, queue, fin|mode, data[offset:offset+size]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *Socket) fragment(ctx context.Context, queue chan net.Buffers, header byte, data []byte) (err error) {
+	var mask []byte
+
+	size := len(data)
+	payload := net.Buffers{[]byte{header, 0}}
+	if size < 126 {
+		payload[0][1] |= byte(size)
+	} else if size < 65536 {
+		payload[0][1] |= 126
+		payload = append(payload, []byte{0, 0})
+		binary.BigEndian.PutUint16(payload[1], uint16(size))
+	} else {
+		payload[0][1] |= 127
+		payload = append(payload, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+		binary.BigEndian.PutUint64(payload[1], uint64(size))
+	}
+	if s.client {
+		payload[0][1] |= WEBSOCKET_MASK
+		mask = s.rmask()
+		payload = append(payload, mask)
+	}
+	if queue != nil {
+		frame := make([]byte, 0, 14+size)
+		for _, buffer := range payload {
+			frame = append(frame, buffer...)
+		}
+		frame = append(frame, data...)
+		if s.client {
+			xor(mask, frame[len(frame)-size:])
+		}
+		s.spending.Add(1)
+		select {
+		case queue <- net.Buffers{frame}:
+			s.count(header, size)
+			return nil
+		default:
+			s.spending.Add(-1)
+			return errors.New(`websocket: send queue full`)
+		}
+	}
+	if s.client {
+		xor(mask, data)
+	}
+	payload = append(payload, data)
+	err = s.sendContext(ctx, payload)
+	if s.client {
+		xor(mask, data)
+	}
+	if err == nil {
+		s.count(header, size)
+	}
+	return
+}
+
+func (s *Socket) count(header byte, size int) {
+	if header&0x0f < WEBSOCKET_OPCODE_CLOSE {
+		s.bsent.Add(int64(size))
+		if header&WEBSOCKET_FIN != 0 {
+			s.msent.Add(1)
+		}
+	}
+}
+
+// urgent frames go first, but only between messages: a lane is followed until its current message is complete
+func (s *Socket) flush() {
+	var current chan net.Buffers
+
+	for {
+		var payload net.Buffers
+
+		lane := current
+		if lane != nil {
+			select {
+			case payload = <-lane:
+			case <-s.stop:
+				return
 			}
-			if s.client {
-				payload[0][1] |= WEBSOCKET_MASK
-				mask = rmask()
-				payload = append(payload, mask)
-				xor(mask, data[offset:offset+size])
+		} else {
+			select {
+			case payload = <-s.uqueue:
+				lane = s.uqueue
+			default:
+				select {
+				case payload = <-s.uqueue:
+					lane = s.uqueue
+				case payload = <-s.squeue:
+					lane = s.squeue
+				case <-s.stop:
+					return
+				}
 			}
-			payload = append(payload, data[offset:offset+size])
-			err = s.send(payload)
-			if s.client {
-				xor(mask, data[offset:offset+size])
+		}
+		current = nil
+		if payload[0][0]&WEBSOCKET_FIN == 0 {
+			current = lane
+		}
+		err := s.send(payload)
+		if s.spending.Add(-1) == 0 {
+			select {
+			case s.sidle <- struct{}{}:
+			default:
 			}
-			if err != nil {
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Socket) keepalive() {
+	ticker := time.NewTicker(s.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.probe.Store(int64(time.Since(epoch)))
+			if s.Ping(s.config.PingPayload) != nil {
+				return
+			}
+			s.event("probe", nil)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Socket) QueueDepth() int {
+	return len(s.squeue) + len(s.uqueue)
+}
+
+// the socket data lock is held until the writer is closed, other writes wait for it
+func (s *Socket) NextWriter(mode byte) (io.WriteCloser, error) {
+	if mode != WEBSOCKET_OPCODE_TEXT && mode != WEBSOCKET_OPCODE_BLOB {
+		return nil, errors.New(`websocket: invalid message mode`)
+	}
+	s.dlock.acquire(false)
+	s.clock.Lock()
+	closing := s.csent
+	s.clock.Unlock()
+	if closing {
+		s.dlock.release()
+		return nil, errors.New(`websocket: closing`)
+	}
+	return &writer{socket: s, mode: mode, buffer: bslab.Get(s.config.FragmentSize, nil)}, nil
+}
+
+func (w *writer) Write(data []byte) (written int, err error) {
+	if w.closed {
+		return 0, errors.New(`websocket: writer closed`)
+	}
+	for len(data) != 0 {
+		if len(w.buffer) >= w.socket.config.FragmentSize {
+			if err = w.socket.fragment(context.Background(), w.socket.squeue, w.mode, w.buffer); err != nil {
 				return
 			}
+			w.mode, w.buffer = 0, w.buffer[:0]
+		}
+		size := int(math.Min(float64(len(data)), float64(w.socket.config.FragmentSize-len(w.buffer))))
+		w.buffer = append(w.buffer, data[:size]...)
+		data, written = data[size:], written+size
+	}
+	return
+}
+
+func (w *writer) Close() (err error) {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buffer) != 0 {
+		err = w.socket.fragment(context.Background(), w.socket.squeue, WEBSOCKET_FIN|w.mode, w.buffer)
+	}
+	bslab.Put(w.buffer)
+	w.buffer = nil
+	w.socket.dlock.release()
+	return
+}
+
+func (s *Socket) ReadMessage(ctx context.Context) (mode int, data []byte, err error) {
+	if s.queue == nil {
+		return 0, nil, errors.New(`websocket: read queue not enabled`)
+	}
+	select {
+	case message, ok := <-s.queue:
+		if !ok {
+			return 0, nil, errors.New(`websocket: not connected`)
 		}
+		return message.mode, message.data, nil
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+func (s *Socket) ReadMessageTimeout(timeout time.Duration) (mode int, data []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if mode, data, err = s.ReadMessage(ctx); err == context.DeadlineExceeded {
+		err = ErrReadTimeout
 	}
 	return
 }
 
-func (s *Socket) Close(code int) {
+func (s *Socket) Ping(payload []byte) (err error) {
+	if len(payload) > 125 {
+		return errors.New(`websocket: ping payload exceeds 125 bytes`)
+	}
+	s.clock.Lock()
+	closing := s.csent
+	s.clock.Unlock()
+	if closing {
+		return errors.New(`websocket: closing`)
+	}
+	return s.send(s.frame(WEBSOCKET_OPCODE_PING, payload))
+}
+
+func (s *Socket) Pong(data []byte) (err error) {
+	if len(data) > 125 {
+		return errors.New(`websocket: pong payload exceeds 125 bytes`)
+	}
+	s.clock.Lock()
+	closing := s.csent
+	s.clock.Unlock()
+	if closing {
+		return errors.New(`websocket: closing`)
+	}
+	return s.send(s.frame(WEBSOCKET_OPCODE_PONG, data))
+}
+
+func (s *Socket) Close(code int) (err error) {
+	return s.CloseReason(code, "")
+}
+
+func (s *Socket) CloseReason(code int, reason string) (err error) {
 	s.clock.Lock()
 	if !s.closing && s.connected {
+		if s.cause == WEBSOCKET_CAUSE_NONE {
+			s.cause = WEBSOCKET_CAUSE_LOCAL
+		}
 		s.closing = true
+		close(s.stop)
+		sent := s.csent
+		s.csent = true
 		s.clock.Unlock()
 		if s.config != nil && s.config.CloseHandler != nil {
 			s.config.CloseHandler(s, code)
 		}
-		payload := net.Buffers{[]byte{WEBSOCKET_FIN | WEBSOCKET_OPCODE_CLOSE, 0}}
-		if s.client {
-			payload[0][1] |= WEBSOCKET_MASK
-			payload = append(payload, rmask())
+		if code != 0 && code != WEBSOCKET_ERROR_NORMAL {
+			s.event("close", fmt.Errorf(`websocket: closed with code %d`, code))
+		} else {
+			s.event("close", nil)
 		}
-		if code != 0 {
-			payload[0][1] |= 2
-			payload = append(payload, []byte{0, 0})
-			binary.BigEndian.PutUint16(payload[len(payload)-1], uint16(code))
-			if s.client {
-				xor(payload[1], payload[2])
-			}
+		if !sent {
+			err = s.send(s.cframe(code, []byte(reason)))
+		}
+		if s.cause == WEBSOCKET_CAUSE_CLOSE {
+			s.linger()
 		}
-		s.send(payload)
 		s.connected = false
 		s.conn.Close()
 	} else {
 		s.clock.Unlock()
+		err = errors.New(`websocket: not connected`)
+	}
+	return
+}
+
+// queued writers are flushed first; when the timeout expires the connection is closed under them
+func (s *Socket) CloseAfterDrain(code int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if s.dlock.acquireContext(ctx, false) == nil {
+	drain:
+		for s.squeue != nil && s.spending.Load() != 0 {
+			select {
+			case <-s.sidle:
+			case <-s.stop:
+				break drain
+			case <-ctx.Done():
+				break drain
+			}
+		}
+		s.dlock.release()
+	}
+	return s.Close(code)
+}
+
+func (s *Socket) event(name string, err error) {
+	if s.config != nil && s.config.OnEvent != nil {
+		s.config.OnEvent(s, name, err)
+	}
+}
+
+// the peer initiated the close handshake: half-close after our acknowledgement and discard what is left,
+// so the connection is not reset under unread data before the peer sees the close frame
+func (s *Socket) linger() {
+	if conn, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+	}
+	s.conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, io.LimitReader(s.conn, 64<<10))
+}
+
+func (s *Socket) CloseCause() int {
+	s.clock.Lock()
+	defer s.clock.Unlock()
+	return s.cause
+}
+
+func (s *Socket) classify(cause int) {
+	s.clock.Lock()
+	if s.cause == WEBSOCKET_CAUSE_NONE {
+		s.cause = cause
+	}
+	s.clock.Unlock()
+}
+
+func (s *Socket) InitiateClose(code int, reason string) (err error) {
+	return s.SendClose(code, []byte(reason))
+}
+
+// emits the close frame only (no close handler, no teardown); later writes fail and Close sends no second frame
+func (s *Socket) SendClose(code int, reason []byte) (err error) {
+	s.clock.Lock()
+	if s.closing || !s.connected || s.csent {
+		s.clock.Unlock()
+		return errors.New(`websocket: not connected`)
+	}
+	s.csent = true
+	s.csince.Store(time.Now().UnixNano())
+	s.clock.Unlock()
+	if err = s.send(s.cframe(code, reason)); err == nil {
+		s.conn.SetReadDeadline(time.Now().Add(s.config.CloseTimeout))
+	}
+	return
+}
+
+func (s *Socket) cframe(code int, reason []byte) net.Buffers {
+	payload := net.Buffers{[]byte{WEBSOCKET_FIN | WEBSOCKET_OPCODE_CLOSE, 0}}
+	if s.client {
+		payload[0][1] |= WEBSOCKET_MASK
+		payload = append(payload, s.rmask())
+	}
+	if code != 0 {
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		body := make([]byte, 2+len(reason))
+		binary.BigEndian.PutUint16(body, uint16(code))
+		copy(body[2:], reason)
+		payload[0][1] |= byte(len(body))
+		if s.client {
+			xor(payload[1], body)
+		}
+		payload = append(payload, body)
+	}
+	return payload
+}
+
+func (s *Socket) frame(opcode byte, data []byte) net.Buffers {
+	payload := net.Buffers{[]byte{WEBSOCKET_FIN | opcode, byte(len(data))}}
+	if len(data) != 0 {
+		data = append([]byte{}, data...)
+	}
+	if s.client {
+		payload[0][1] |= WEBSOCKET_MASK
+		payload = append(payload, s.rmask())
+		xor(payload[1], data)
 	}
+	return append(payload, data)
 }
 
 func (s *Socket) send(payload net.Buffers) (err error) {
+	return s.sendContext(context.Background(), payload)
+}
+
+func (s *Socket) sendContext(ctx context.Context, payload net.Buffers) (err error) {
 	if !s.connected {
 		return errors.New(`websocket: not connected`)
 	}
-	s.wlock.Lock()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if s.config.OutboundLimiter != nil && payload[0][0]&0x0f < WEBSOCKET_OPCODE_CLOSE {
+		size := 0
+		for _, buffer := range payload {
+			size += len(buffer)
+		}
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(s.config.WriteTimeout))
+		err = s.config.OutboundLimiter.WaitN(ctx, size)
+		cancel()
+		if err != nil {
+			return fmt.Errorf(`websocket: outbound limit: %v`, err)
+		}
+	}
+	opcode := payload[0][0] & 0x0f
+	s.wlock.acquire(opcode >= WEBSOCKET_OPCODE_CLOSE)
+	// checked under the write lock, a frame the flusher already dequeued cannot follow our close frame
+	if s.cwritten {
+		s.wlock.release()
+		return errors.New(`websocket: closing`)
+	}
 	lnow := atomic.LoadInt64(&now)
-	if time.Duration(lnow-s.slast) >= time.Second {
+	if deadline, ok := ctx.Deadline(); ok {
+		if limit := time.Now().Add(time.Duration(s.config.WriteTimeout)); limit.Before(deadline) {
+			deadline = limit
+		}
+		s.slast = 0
+		s.conn.SetWriteDeadline(deadline)
+	} else if time.Duration(lnow-s.slast) >= time.Second {
 		s.slast = lnow
 		s.conn.SetWriteDeadline(time.UnixMicro(lnow / int64(time.Microsecond)).Add(time.Duration(s.config.WriteTimeout)))
 	}
 	if _, err = payload.WriteTo(s.conn); err != nil {
-		s.wlock.Unlock()
+		s.wlock.release()
+		s.classify(WEBSOCKET_CAUSE_ERROR)
 		s.Close(0)
 	} else {
-		s.wlock.Unlock()
+		s.cwritten = opcode == WEBSOCKET_OPCODE_CLOSE
+		s.wlock.release()
 	}
 	return
 }
 
 func (s *Socket) receive(buffered io.Reader) {
-	var data, control []byte
+	var data, control, partial []byte
+	var stream *io.PipeWriter
+	var streamed chan struct{}
 	var err error
 
-	fin, opcode, size, mask, smask := byte(0), byte(0), -1, make([]byte, 4), 0
-	seen, code, dmode, dsize, doffset, dlast := atomic.LoadInt64(&now), 0, byte(0), 0, 0, false
-	buffer, roffset, woffset, read := bslab.Get(s.config.ReadSize, nil), 0, 0, 0
+	fin, opcode, size, mask, smask, spos, pinged, dframes := byte(0), byte(0), -1, make([]byte, 4), 0, 0, int64(0), 0
+	seen, code, cause, dmode, dsize, doffset, dlast, dstart := atomic.LoadInt64(&now), 0, WEBSOCKET_CAUSE_NONE, byte(0), 0, 0, false, int64(0)
+	buffer, roffset, woffset, read, rsize, msize := bslab.Get(s.config.ReadSize, nil), 0, 0, 0, s.config.ReadSize, s.config.MessageSize
 	buffer = buffer[:cap(buffer)]
-	if !s.client {
-		smask += 4
+	if s.config.PingInterval > 0 {
+		go s.keepalive()
 	}
 close:
 	for {
+		if value := int(s.rsize.Load()); value != 0 && value != rsize && woffset-roffset < value {
+			resized := bslab.Get(value, nil)
+			resized = resized[:cap(resized)]
+			copy(resized, buffer[roffset:woffset])
+			bslab.Put(buffer)
+			buffer, woffset, roffset, rsize = resized, woffset-roffset, 0, value
+		}
 		if cap(buffer)-roffset < 14 {
 			copy(buffer[0:], buffer[roffset:woffset])
 			woffset -= roffset
@@ -468,7 +1538,26 @@ close:
 		lnow := atomic.LoadInt64(&now)
 		if time.Duration(lnow-s.rlast) >= time.Second {
 			s.rlast = lnow
-			s.conn.SetReadDeadline(time.UnixMicro(lnow / int64(time.Microsecond)).Add(time.Duration(s.config.ProbeTimeout)))
+			deadline := time.UnixMicro(lnow / int64(time.Microsecond)).Add(time.Duration(s.config.ProbeTimeout))
+			if s.config.NoProbe {
+				deadline = time.UnixMicro(lnow / int64(time.Microsecond)).Add(time.Duration(s.config.InactiveTimeout))
+			}
+			if dmode != 0 && s.config.MessageAssembleTimeout > 0 {
+				if limit := time.Unix(0, dstart).Add(s.config.MessageAssembleTimeout); limit.Before(deadline) {
+					deadline = limit
+				}
+			}
+			if pinged != 0 && s.config.PongTimeout > 0 {
+				if limit := time.Unix(0, pinged).Add(s.config.PongTimeout); limit.Before(deadline) {
+					deadline = limit
+				}
+			}
+			if since := s.csince.Load(); since != 0 {
+				if limit := time.Unix(0, since).Add(s.config.CloseTimeout); limit.Before(deadline) {
+					deadline = limit
+				}
+			}
+			s.conn.SetReadDeadline(deadline)
 		}
 		if buffered != nil {
 			read, err = buffered.Read(buffer[woffset:])
@@ -478,26 +1567,44 @@ close:
 		}
 
 		if read > 0 {
-			seen = atomic.LoadInt64(&now)
+			seen, pinged = atomic.LoadInt64(&now), 0
 			woffset += read
 			for {
 				if size < 0 {
 					if woffset-roffset >= 2 {
-						fin, opcode, size = buffer[roffset]>>7, buffer[roffset]&0x0f, int(buffer[roffset+1]&0x7f)
-						if (s.client && (buffer[roffset+1]&WEBSOCKET_MASK) != 0) || (!s.client && (buffer[roffset+1]&WEBSOCKET_MASK) == 0) ||
-							(fin == 0 && opcode >= WEBSOCKET_OPCODE_CLOSE && opcode <= WEBSOCKET_OPCODE_PONG) ||
+						fin, opcode, size, smask = buffer[roffset]>>7, buffer[roffset]&0x0f, int(buffer[roffset+1]&0x7f), 0
+						if buffer[roffset+1]&WEBSOCKET_MASK != 0 {
+							smask = 4
+						}
+						// no implemented extension claims an RSV bit, negotiated passthrough extensions included
+						if (s.client && smask != 0) || (!s.client && smask == 0 && !s.config.AllowUnmaskedClient) ||
+							buffer[roffset]&WEBSOCKET_RSV != 0 ||
+							(opcode >= WEBSOCKET_OPCODE_CLOSE && (fin == 0 || size > 125)) ||
 							(opcode != 0 && opcode != WEBSOCKET_OPCODE_TEXT && opcode != WEBSOCKET_OPCODE_BLOB && (opcode < WEBSOCKET_OPCODE_CLOSE || opcode > WEBSOCKET_OPCODE_PONG)) {
 							code = WEBSOCKET_ERROR_PROTOCOL
 							break close
 						}
-						if !s.client && woffset-roffset < 2+smask {
+						if woffset-roffset < 2+smask {
 							size = -1
 							break
 						}
+						if (opcode == 0 && dmode == 0) || ((opcode == WEBSOCKET_OPCODE_TEXT || opcode == WEBSOCKET_OPCODE_BLOB) && dmode != 0) {
+							code = WEBSOCKET_ERROR_PROTOCOL
+							break close
+						}
 						if opcode == WEBSOCKET_OPCODE_TEXT || opcode == WEBSOCKET_OPCODE_BLOB {
-							dmode = opcode
+							dmode, dstart, dframes, s.rlast = opcode, atomic.LoadInt64(&now), 0, 0
+							if value := int(s.msize.Load()); value != 0 {
+								msize = value
+							}
+						}
+						if opcode < WEBSOCKET_OPCODE_CLOSE {
+							if dframes++; s.config.MaxFragments > 0 && dframes > s.config.MaxFragments {
+								code = WEBSOCKET_ERROR_PROTOCOL
+								break close
+							}
 						}
-						if dmode != 0 && fin == 1 {
+						if opcode < WEBSOCKET_OPCODE_CLOSE && fin == 1 {
 							dlast = true
 						}
 						if size == 126 {
@@ -506,7 +1613,7 @@ close:
 								break
 							}
 							size = int(binary.BigEndian.Uint16(buffer[roffset+2:]))
-							if !s.client {
+							if smask != 0 {
 								copy(mask, buffer[roffset+4:])
 							}
 							roffset += 4 + smask
@@ -516,54 +1623,112 @@ close:
 								break
 							}
 							size = int(binary.BigEndian.Uint64(buffer[roffset+2:]))
-							if !s.client {
+							if smask != 0 {
 								copy(mask, buffer[roffset+10:])
 							}
 							roffset += 10 + smask
 						} else {
-							if !s.client {
+							if smask != 0 {
 								copy(mask, buffer[roffset+2:])
 							}
 							roffset += 2 + smask
 						}
-						if (opcode <= WEBSOCKET_OPCODE_BLOB && size == 0) || (opcode > WEBSOCKET_OPCODE_BLOB && size > 125) || (fin == 1 && size > s.config.MessageSize) {
+						if s.config.FrameHandler != nil {
+							s.config.FrameHandler(s, fin == 1, opcode, size)
+						}
+						if (opcode <= WEBSOCKET_OPCODE_BLOB && size == 0) || (fin == 1 && size > msize && s.config.StreamHandler == nil) {
 							code = WEBSOCKET_ERROR_OVERSIZED
 							break close
 						}
-						if dmode != 0 {
+						if opcode < WEBSOCKET_OPCODE_CLOSE {
 							dsize += size
 						}
+						if opcode <= WEBSOCKET_OPCODE_BLOB && int64(size) > s.fmax.Load() {
+							s.fmax.Store(int64(size))
+						}
 					} else {
 						break
 					}
 				}
 
 				if size >= 0 {
-					if dmode != 0 {
+					if opcode < WEBSOCKET_OPCODE_CLOSE && s.config.StreamHandler != nil {
+						if stream == nil {
+							reader, output := io.Pipe()
+							stream, streamed = output, make(chan struct{})
+							go func(mode int, reader *io.PipeReader, streamed chan struct{}) {
+								s.config.StreamHandler(s, mode, reader)
+								reader.Close()
+								close(streamed)
+							}(int(dmode), reader, streamed)
+						}
+						max := int(math.Min(float64(woffset-roffset), float64(size)))
+						if smask != 0 {
+							rotated := []byte{mask[spos%4], mask[(spos+1)%4], mask[(spos+2)%4], mask[(spos+3)%4]}
+							xor(rotated, buffer[roffset:roffset+max])
+						}
+						if dmode == WEBSOCKET_OPCODE_TEXT && !s.config.SkipUTF8Validation {
+							valid := false
+							if partial, valid = utf8chunk(partial, buffer[roffset:roffset+max]); !valid || (dlast && size == max && len(partial) != 0) {
+								code = WEBSOCKET_ERROR_INVALID
+								break close
+							}
+						}
+						stream.Write(buffer[roffset : roffset+max])
+						// a slow consumer holds the loop in Write, the time spent there is not peer inactivity
+						seen, s.rlast = atomic.LoadInt64(&now), 0
+						s.breceived.Add(int64(max))
+						size -= max
+						roffset += max
+						spos += max
+						if size <= 0 {
+							if dlast {
+								partial = partial[:0]
+								s.mreceived.Add(1)
+								stream.Close()
+								<-streamed
+								stream, dmode, dsize, doffset, dlast = nil, 0, 0, 0, false
+							}
+							size, spos = -1, 0
+						}
+					} else if opcode < WEBSOCKET_OPCODE_CLOSE {
 						if data == nil {
 							data = bslab.Get(dsize, nil)
 						}
 						max := int(math.Min(float64(woffset-roffset), float64(size)))
-						if len(data)+max > s.config.MessageSize {
+						if len(data)+max > msize {
 							code = WEBSOCKET_ERROR_OVERSIZED
 							break close
 						}
 						data = append(data, buffer[roffset:roffset+max]...)
+						s.breceived.Add(int64(max))
 						size -= max
 						roffset += max
 						if size <= 0 && len(data) >= dsize {
-							if !s.client {
+							if smask != 0 {
 								xor(mask, data[doffset:dsize])
 							}
 							doffset = dsize
 							if dlast {
-								if dmode == WEBSOCKET_OPCODE_TEXT && !utf8.Valid(data) {
-									code = WEBSOCKET_ERROR_INVALID
-									break close
+								mode := int(dmode)
+								if dmode == WEBSOCKET_OPCODE_TEXT && !s.config.SkipUTF8Validation && !utf8.Valid(data) {
+									if !s.config.LenientUTF8 {
+										code = WEBSOCKET_ERROR_INVALID
+										break close
+									}
+									// lenient sockets still get the message, flagged in its mode
+									mode |= WEBSOCKET_INVALID_UTF8
 								}
+								s.mreceived.Add(1)
 								keep := false
-								if s.config.MessageHandler != nil {
-									keep = s.config.MessageHandler(s, int(dmode), data)
+								if s.queue != nil {
+									select {
+									case s.queue <- message{mode, data}:
+										keep = true
+									case <-s.stop:
+									}
+								} else if s.config.MessageHandler != nil {
+									keep = s.config.MessageHandler(s, mode, data)
 								}
 								if !keep {
 									bslab.Put(data)
@@ -581,25 +1746,46 @@ close:
 						size -= max
 						roffset += max
 						if size <= 0 {
-							if !s.client {
+							if smask != 0 {
 								xor(mask, control)
 							}
 							switch opcode {
 							case WEBSOCKET_OPCODE_CLOSE:
+								if len(control) == 1 {
+									code = WEBSOCKET_ERROR_PROTOCOL
+									break close
+								}
+								code = WEBSOCKET_ERROR_NORMAL
 								if len(control) >= 2 {
 									code = int(binary.BigEndian.Uint16(control))
+									if !ccode(code) {
+										code = WEBSOCKET_ERROR_PROTOCOL
+										break close
+									}
+									if !utf8.Valid(control[2:]) {
+										code = WEBSOCKET_ERROR_INVALID
+										break close
+									}
 								}
+								cause = WEBSOCKET_CAUSE_CLOSE
 								break close
 							case WEBSOCKET_OPCODE_PING:
-								payload := net.Buffers{[]byte{WEBSOCKET_FIN | WEBSOCKET_OPCODE_PONG, byte(len(control))}}
-								if s.client {
-									payload[0][1] |= WEBSOCKET_MASK
-									payload = append(payload, rmask())
-									xor(payload[1], control)
+								if s.config.PingHandler != nil {
+									s.config.PingHandler(s, append([]byte{}, control...))
+								} else if s.csince.Load() == 0 {
+									if err := s.send(s.frame(WEBSOCKET_OPCODE_PONG, control)); err != nil {
+										break close
+									}
 								}
-								payload = append(payload, control)
-								if err := s.send(payload); err != nil {
-									break close
+							case WEBSOCKET_OPCODE_PONG:
+								if bytes.Equal(control, s.config.PingPayload) {
+									if sent := s.probe.Swap(0); sent != 0 {
+										s.rtt.Store(int64(time.Since(epoch)) - sent)
+										s.lprobe.Store(time.Now().UnixNano())
+									}
+								}
+								if s.config.PongHandler != nil {
+									s.config.PongHandler(s, append([]byte{}, control...))
 								}
 							}
 							bslab.Put(control)
@@ -615,39 +1801,254 @@ close:
 			}
 		}
 
+		if dmode != 0 && s.config.MessageAssembleTimeout > 0 && time.Since(time.Unix(0, dstart)) >= s.config.MessageAssembleTimeout {
+			code, cause = WEBSOCKET_ERROR_POLICY, WEBSOCKET_CAUSE_TIMEOUT
+			break close
+		}
+		if pinged != 0 && s.config.PongTimeout > 0 && time.Since(time.Unix(0, pinged)) >= s.config.PongTimeout {
+			code, cause = WEBSOCKET_ERROR_UNEXPECTED, WEBSOCKET_CAUSE_TIMEOUT
+			break close
+		}
+		// no close echo from the peer within CloseTimeout after our own close frame
+		if since := s.csince.Load(); since != 0 && time.Since(time.Unix(0, since)) >= s.config.CloseTimeout {
+			cause = WEBSOCKET_CAUSE_TIMEOUT
+			break close
+		}
 		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				payload := net.Buffers{[]byte{WEBSOCKET_FIN | WEBSOCKET_OPCODE_PING, 0}}
-				if s.client {
-					payload[0][1] |= WEBSOCKET_MASK
-					payload = append(payload, rmask())
-				}
-				if err := s.send(payload); err != nil {
-					break close
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && !s.config.NoProbe {
+				if s.csince.Load() == 0 {
+					if pinged == 0 {
+						pinged, s.rlast = time.Now().UnixNano(), 0
+					}
+					s.probe.Store(int64(time.Since(epoch)))
+					if err := s.send(s.frame(WEBSOCKET_OPCODE_PING, s.config.PingPayload)); err != nil {
+						break close
+					}
+					s.event("probe", nil)
 				}
 			} else {
+				cause = WEBSOCKET_CAUSE_ERROR
+				if errors.Is(err, io.EOF) {
+					cause = WEBSOCKET_CAUSE_EOF
+				} else if ok && nerr.Timeout() {
+					cause = WEBSOCKET_CAUSE_TIMEOUT
+				}
 				break close
 			}
 		} else if read == 0 {
+			cause = WEBSOCKET_CAUSE_EOF
 			break close
 		}
 
 		if atomic.LoadInt64(&now)-seen >= s.config.InactiveTimeout {
+			cause = WEBSOCKET_CAUSE_TIMEOUT
 			break close
 		}
 	}
+	if stream != nil {
+		stream.CloseWithError(io.ErrUnexpectedEOF)
+	}
 	bslab.Put(buffer)
 	bslab.Put(control)
 	bslab.Put(data)
+	if cause == WEBSOCKET_CAUSE_NONE {
+		cause = WEBSOCKET_CAUSE_ERROR
+		if code != 0 {
+			cause = WEBSOCKET_CAUSE_PROTOCOL
+		}
+	}
+	s.classify(cause)
+	if cause == WEBSOCKET_CAUSE_PROTOCOL {
+		s.event("protocol-error", fmt.Errorf(`websocket: protocol error, closing with code %d`, code))
+	}
 	s.Close(code)
+	if s.queue != nil {
+		close(s.queue)
+	}
+	close(s.done)
+}
+
+func (p *plock) acquire(urgent bool) {
+	p.acquireContext(context.Background(), urgent)
+}
+
+func (p *plock) acquireContext(ctx context.Context, urgent bool) error {
+	var stop chan struct{}
+
+	lane := 0
+	if urgent {
+		lane = 1
+	}
+	p.lock.Lock()
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.lock)
+	}
+	ticket := p.tickets[lane]
+	p.tickets[lane]++
+	for p.busy || ticket != p.serving[lane] || (lane == 0 && p.serving[1] != p.tickets[1]) {
+		if ctx.Err() != nil {
+			// the abandoned ticket is skipped when its turn comes
+			if p.abandoned[lane] == nil {
+				p.abandoned[lane] = map[uint64]bool{}
+			}
+			p.abandoned[lane][ticket] = true
+			p.advance()
+			p.cond.Broadcast()
+			p.lock.Unlock()
+			if stop != nil {
+				close(stop)
+			}
+			return ctx.Err()
+		}
+		if stop == nil && ctx.Done() != nil {
+			stop = make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					p.lock.Lock()
+					p.cond.Broadcast()
+					p.lock.Unlock()
+				case <-stop:
+				}
+			}()
+		}
+		p.cond.Wait()
+	}
+	p.serving[lane]++
+	p.advance()
+	p.busy = true
+	p.lock.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	return nil
+}
+
+func (p *plock) advance() {
+	for lane := range p.serving {
+		for p.abandoned[lane][p.serving[lane]] {
+			delete(p.abandoned[lane], p.serving[lane])
+			p.serving[lane]++
+		}
+	}
+}
+
+func (p *plock) release() {
+	p.lock.Lock()
+	p.busy = false
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
+
+func protocols(header string) (list []string) {
+	if splitter := rcache.Get("[, ]+"); splitter != nil {
+		for _, value := range splitter.Split(header, 10) {
+			if value != "" {
+				list = append(list, value)
+			}
+		}
+	}
+	return
+}
+
+func extensions(header string) (list []string, valid bool) {
+	if len(header) > 4<<10 {
+		return nil, false
+	}
+	for _, value := range strings.Split(header, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		parameters := strings.Split(value, ";")
+		if len(list) >= 16 || len(parameters) > 17 {
+			return nil, false
+		}
+		if name := strings.ToLower(strings.TrimSpace(parameters[0])); name != "" {
+			list = append(list, name)
+		}
+	}
+	return list, true
+}
+
+// validates text split across chunks, partial carries the bytes of a rune cut at the end of the previous chunk
+func utf8chunk(partial, data []byte) ([]byte, bool) {
+	for len(partial) != 0 && len(data) != 0 {
+		partial, data = append(partial, data[0]), data[1:]
+		if utf8.FullRune(partial) {
+			if value, size := utf8.DecodeRune(partial); value == utf8.RuneError && size <= 1 {
+				return partial, false
+			}
+			partial = partial[:0]
+		}
+	}
+	cut := len(data)
+	for index := len(data) - 1; index >= 0 && index >= len(data)-3; index-- {
+		if utf8.RuneStart(data[index]) {
+			if !utf8.FullRune(data[index:]) {
+				cut = index
+			}
+			break
+		}
+	}
+	if !utf8.Valid(data[:cut]) {
+		return partial, false
+	}
+	return append(partial, data[cut:]...), true
+}
+
+func match(offered, supported []string) (protocol string) {
+	if len(offered) > 0 {
+		oprotocols := map[string]bool{}
+		for _, value := range offered {
+			oprotocols[value] = true
+		}
+		for _, value := range supported {
+			if oprotocols[value] {
+				return value
+			}
+		}
+	}
+	return
 }
 
-func rmask() []byte {
+func (s *Socket) rmask() []byte {
 	value := []byte{0, 0, 0, 0}
-	rand.Read(value)
+	s.mlock.Lock()
+	if s.moffset+4 > len(s.masks) {
+		if s.masks == nil {
+			s.masks = make([]byte, 256)
+		}
+		if _, err := crand.Read(s.masks); err != nil {
+			rand.Read(s.masks)
+		}
+		s.moffset = 0
+	}
+	copy(value, s.masks[s.moffset:])
+	s.moffset += 4
+	s.mlock.Unlock()
 	return value
 }
 
+func ccode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014, code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// inline PEM data takes precedence over the file path
+func pemdata(data []byte, path string) ([]byte, error) {
+	if data != nil || path == "" {
+		return data, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf(`websocket: %v`, err)
+	}
+	return data, nil
+}
+
 func cval(value, fallback, min, max int) int {
 	if value == 0 {
 		value = fallback
@@ -663,21 +2064,24 @@ func cval(value, fallback, min, max int) int {
 
 const xorsize = int(unsafe.Sizeof(uintptr(0)))
 
+// word-sized loads and stores only start once data is aligned, the leading bytes are masked one by one
 func xor(mask []byte, data []byte) {
 	offset, length := 0, len(data)
-	if length >= xorsize {
-		var value [xorsize]byte
+	if length >= 2*xorsize {
+		for head := int((uintptr(xorsize) - uintptr(unsafe.Pointer(&data[0]))%uintptr(xorsize)) % uintptr(xorsize)); offset < head; offset++ {
+			data[offset] ^= mask[offset%4]
+		}
+		var xorer uintptr
 
+		value := (*[xorsize]byte)(unsafe.Pointer(&xorer))
 		for index := range value {
-			value[index] = mask[index%4]
+			value[index] = mask[(offset+index)%4]
 		}
-		xorer := *(*uintptr)(unsafe.Pointer(&value))
-		offset = (length / xorsize) * xorsize
-		for index := 0; index < offset; index += xorsize {
-			*(*uintptr)(unsafe.Pointer(uintptr(unsafe.Pointer(&data[0])) + uintptr(index))) ^= xorer
+		for end := offset + ((length-offset)/xorsize)*xorsize; offset < end; offset += xorsize {
+			*(*uintptr)(unsafe.Pointer(&data[offset])) ^= xorer
 		}
 	}
-	for index := offset; index < length; index++ {
-		data[index] ^= mask[(index-offset)%4]
+	for ; offset < length; offset++ {
+		data[offset] ^= mask[offset%4]
 	}
 }
@@ -0,0 +1,591 @@
+package uws
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, config *Config) *httptest.Server {
+	t.Helper()
+	server := NewServer(config)
+	listener := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if handled, _ := server.Handle(response, request); !handled {
+			response.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(listener.Close)
+	return listener
+}
+
+func pair(t *testing.T, config *Config) (client, server *Socket, closer func()) {
+	t.Helper()
+	accepted := make(chan *Socket, 1)
+	config.OpenHandler = func(ws *Socket) {
+		accepted <- ws
+	}
+	listener := serve(t, config)
+	client, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server socket not accepted")
+	}
+	return client, server, func() {
+		client.Close(0)
+		server.Close(0)
+	}
+}
+
+func handshake(t *testing.T, address string, headers map[string]string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	request := "GET / HTTP/1.1\r\nHost: " + address + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	for name, value := range headers {
+		request += name + ": " + value + "\r\n"
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+// reads one unmasked server frame
+func next(reader *bufio.Reader) (header byte, payload []byte, err error) {
+	prefix := make([]byte, 2)
+	if _, err = io.ReadFull(reader, prefix); err != nil {
+		return
+	}
+	size := int(prefix[1] & 0x7f)
+	if size >= 126 {
+		extended := make([]byte, map[int]int{126: 2, 127: 8}[size])
+		if _, err = io.ReadFull(reader, extended); err != nil {
+			return
+		}
+		if size == 126 {
+			size = int(binary.BigEndian.Uint16(extended))
+		} else {
+			size = int(binary.BigEndian.Uint64(extended))
+		}
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	return prefix[0], payload, err
+}
+
+func TestControlFrameExtendedLength(t *testing.T) {
+	listener := serve(t, &Config{})
+	conn, reader, response := handshake(t, strings.TrimPrefix(listener.URL, "http://"), nil)
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected handshake status %d", response.StatusCode)
+	}
+
+	// masked PING announcing a 126 extended length, the rejection must not wait for the length bytes
+	if _, err := conn.Write([]byte{WEBSOCKET_FIN | WEBSOCKET_OPCODE_PING, WEBSOCKET_MASK | 126}); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != WEBSOCKET_FIN|WEBSOCKET_OPCODE_CLOSE || binary.BigEndian.Uint16(frame[2:]) != WEBSOCKET_ERROR_PROTOCOL {
+		t.Fatalf("expected a %d close frame, got % x", WEBSOCKET_ERROR_PROTOCOL, frame)
+	}
+}
+
+func TestUnofferedProtocol(t *testing.T) {
+	for _, protocol := range []string{"superchat", "chat, superchat"} {
+		listener := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			conn, _, err := response.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			key := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + WEBSOCKET_UUID))
+			io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+				"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(key[:])+"\r\nSec-WebSocket-Protocol: "+protocol+"\r\n\r\n")
+		}))
+		ws, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", &Config{Protocols: []string{"chat"}})
+		listener.Close()
+		if err == nil {
+			ws.Close(0)
+			t.Fatalf("dial succeeded although the server selected %q", protocol)
+		}
+	}
+}
+
+func TestPathologicalExtensions(t *testing.T) {
+	// permessage-deflate is allowed but never negotiated, uws cannot decode it
+	listener := serve(t, &Config{AllowedExtensions: []string{"x-known", "permessage-deflate"}})
+	address := strings.TrimPrefix(listener.URL, "http://")
+	for _, header := range []string{
+		strings.Repeat("x-known, ", 17),
+		"x-known" + strings.Repeat("; a=1", 20),
+		strings.Repeat(",", 5<<10),
+		"x-known; " + strings.Repeat("a", 5<<10),
+	} {
+		if _, _, response := handshake(t, address, map[string]string{"Sec-WebSocket-Extensions": header}); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected status %d for a %d bytes header, got %d", http.StatusBadRequest, len(header), response.StatusCode)
+		}
+	}
+
+	_, _, response := handshake(t, address, map[string]string{"Sec-WebSocket-Extensions": "x-unknown; a=1, x-known; b=2, X-KNOWN, permessage-deflate"})
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected handshake status %d", response.StatusCode)
+	}
+	if value := response.Header.Get("Sec-WebSocket-Extensions"); value != "x-known" {
+		t.Fatalf("expected only the allowed extension to be negotiated, got %q", value)
+	}
+}
+
+func TestDialNetwork(t *testing.T) {
+	listener := serve(t, &Config{})
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(listener.URL, "http://"))
+	endpoint := "ws://localhost:" + port + "/"
+
+	ws, err := Dial(endpoint, "", &Config{Network: "tcp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close(0)
+	if address, ok := ws.LocalAddr().(*net.TCPAddr); !ok || address.IP.To4() == nil {
+		t.Fatalf("expected an IPv4 connection, got %v", ws.LocalAddr())
+	}
+	if ws, err := Dial(endpoint, "", &Config{Network: "tcp6"}); err == nil {
+		ws.Close(0)
+		t.Fatalf("tcp6 dial reached an IPv4-only listener")
+	}
+}
+
+func TestXorMisaligned(t *testing.T) {
+	mask, buffer := []byte{0x12, 0x34, 0x56, 0x78}, make([]byte, 256)
+	for index := range buffer {
+		buffer[index] = byte(index * 7)
+	}
+	for start := 0; start < 2*xorsize; start++ {
+		for size := 0; size < 4*xorsize+3; size++ {
+			data := append([]byte{}, buffer...)
+			xor(mask, data[start:start+size])
+			for index := range data {
+				expected := buffer[index]
+				if index >= start && index < start+size {
+					expected ^= mask[(index-start)%4]
+				}
+				if data[index] != expected {
+					t.Fatalf("start %d size %d: byte %d is %02x, expected %02x", start, size, index, data[index], expected)
+				}
+			}
+		}
+	}
+}
+
+func TestUTF8Options(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		mode   int
+		code   int
+	}{
+		{Config{}, 0, WEBSOCKET_ERROR_INVALID},
+		{Config{LenientUTF8: true}, WEBSOCKET_OPCODE_TEXT | WEBSOCKET_INVALID_UTF8, 0},
+		{Config{SkipUTF8Validation: true}, WEBSOCKET_OPCODE_TEXT, 0},
+	} {
+		modes, codes := make(chan int, 1), make(chan int, 1)
+		test.config.MessageHandler = func(_ *Socket, mode int, _ []byte) bool {
+			modes <- mode
+			return true
+		}
+		test.config.CloseHandler = func(_ *Socket, code int) {
+			codes <- code
+		}
+		listener := serve(t, &test.config)
+		ws, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.Write(WEBSOCKET_OPCODE_TEXT, []byte{'a', 0xff, 'b'})
+		select {
+		case mode := <-modes:
+			if mode != test.mode {
+				t.Fatalf("expected mode %#x, got %#x", test.mode, mode)
+			}
+		case code := <-codes:
+			if code != test.code {
+				t.Fatalf("expected close code %d, got %d", test.code, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message or close received")
+		}
+		ws.Close(0)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	hub, accepted := &Hub{}, make(chan *Socket, 1)
+	server := NewServer(&Config{OpenHandler: func(ws *Socket) {
+		accepted <- ws
+	}})
+	listener := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		server.Handle(response, request)
+	}))
+	defer listener.Close()
+	codes := make(chan int, 1)
+	dial := func() {
+		if _, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", &Config{CloseHandler: func(_ *Socket, code int) {
+			codes <- code
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for index, stop := range []func(context.Context) error{server.Shutdown, hub.Shutdown} {
+		dial()
+		if ws := <-accepted; index == 1 {
+			hub.Add(ws)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := stop(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := <-codes; code != WEBSOCKET_ERROR_GOINGAWAY {
+			t.Fatalf("expected close code %d, got %d", WEBSOCKET_ERROR_GOINGAWAY, code)
+		}
+		if server.Count() != 0 || hub.Count() != 0 {
+			t.Fatalf("sockets left after shutdown: server %d hub %d", server.Count(), hub.Count())
+		}
+	}
+}
+
+func TestWriteContextWaitingWriter(t *testing.T) {
+	client, _, closer := pair(t, &Config{})
+	defer closer()
+
+	// hold the data lane as a large concurrent message would
+	client.dlock.acquire(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	start, err := time.Now(), client.WriteContext(ctx, WEBSOCKET_OPCODE_TEXT, []byte("late"))
+	cancel()
+	if err != context.DeadlineExceeded || time.Since(start) > 2*time.Second {
+		t.Fatalf("expected the wait to end with the deadline, got %v after %v", err, time.Since(start))
+	}
+	client.dlock.release()
+
+	if err := client.WriteContext(context.Background(), WEBSOCKET_OPCODE_TEXT, []byte("next")); err != nil {
+		t.Fatalf("write after an abandoned wait failed: %v", err)
+	}
+	if !client.IsConnected() {
+		t.Fatal("socket closed by a cancelled wait")
+	}
+}
+
+func TestCloseAfterDrain(t *testing.T) {
+	received := make(chan int, 64)
+	listener := serve(t, &Config{MessageHandler: func(_ *Socket, _ int, data []byte) bool {
+		received <- len(data)
+		return false
+	}})
+	endpoint := "ws" + strings.TrimPrefix(listener.URL, "http")
+
+	queued, err := Dial(endpoint, "", &Config{SendQueue: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 16; index++ {
+		if err := queued.Write(WEBSOCKET_OPCODE_BLOB, make([]byte, 64<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := queued.CloseAfterDrain(WEBSOCKET_ERROR_NORMAL, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 16; index++ {
+		select {
+		case size := <-received:
+			if size != 64<<10 {
+				t.Fatalf("unexpected message size %d", size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d messages delivered before close", index)
+		}
+	}
+
+	// a writer that is never closed must not hold the close past the timeout
+	listener = serve(t, &Config{})
+	held, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", &Config{SendQueue: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := held.NextWriter(WEBSOCKET_OPCODE_TEXT); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	held.CloseAfterDrain(WEBSOCKET_ERROR_NORMAL, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second || held.IsConnected() {
+		t.Fatalf("close took %v, connected %v", elapsed, held.IsConnected())
+	}
+}
+
+func TestPendingHandshakesReleased(t *testing.T) {
+	var server *Server
+
+	opened, proceed := make(chan int, 2), make(chan struct{})
+	config := &Config{MaxPendingHandshakes: 1}
+	config.OpenHandler = func(_ *Socket) {
+		opened <- server.PendingHandshakes()
+		<-proceed
+	}
+	server = NewServer(config)
+	listener := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		server.Handle(response, request)
+	}))
+	defer listener.Close()
+	defer close(proceed)
+
+	endpoint := "ws" + strings.TrimPrefix(listener.URL, "http")
+	go Dial(endpoint, "", nil)
+	select {
+	case pending := <-opened:
+		if pending != 0 {
+			t.Fatalf("handshake slot still held in OpenHandler: %d pending", pending)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket not opened")
+	}
+
+	// the first OpenHandler is still running, the only slot must be available again
+	ws, err := Dial(endpoint, "", nil)
+	if err != nil {
+		t.Fatalf("second handshake rejected: %v", err)
+	}
+	ws.Close(1000)
+}
+
+func TestTLSMaterial(t *testing.T) {
+	for _, config := range []*Config{
+		{RootCAsFile: "/nonexistent/ca.pem"},
+		{RootCAs: []byte("not a certificate")},
+		{ClientCert: []byte("not a certificate")},
+	} {
+		if _, err := Dial("wss://127.0.0.1:1/", "", config); err == nil || !strings.HasPrefix(err.Error(), "websocket: ") {
+			t.Fatalf("unexpected error for %+v: %v", config, err)
+		}
+	}
+}
+
+func TestTLSFilesReloaded(t *testing.T) {
+	server := NewServer(&Config{})
+	listener := httptest.NewTLSServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		server.Handle(response, request)
+	}))
+	defer listener.Close()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: listener.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, endpoint := &Config{RootCAsFile: path}, "wss"+strings.TrimPrefix(listener.URL, "https")
+	ws, err := Dial(endpoint, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.Close(0)
+	if config.TLSConfig != nil {
+		t.Fatal("TLS configuration stored in the caller's config")
+	}
+
+	// the authorities file is read again on the next dial
+	if err := os.WriteFile(path, []byte("rotated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Dial(endpoint, "", config); err == nil {
+		t.Fatal("dial succeeded with the previous authorities")
+	}
+}
+
+func TestUrgentLane(t *testing.T) {
+	accepted := make(chan *Socket, 1)
+	listener := serve(t, &Config{SendQueue: 2048, OpenHandler: func(ws *Socket) { accepted <- ws }})
+	conn, reader, _ := handshake(t, strings.TrimPrefix(listener.URL, "http://"), nil)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	ws := <-accepted
+
+	// the peer does not read yet, so the queue backs up behind the socket buffers
+	messages, blob := 400, make([]byte, 64<<10)
+	for index := 0; index < messages; index++ {
+		if err := ws.Write(WEBSOCKET_OPCODE_BLOB, blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ws.WriteUrgent(WEBSOCKET_OPCODE_TEXT, []byte("urgent")); err != nil {
+		t.Fatal(err)
+	}
+
+	complete, fin := 0, true
+	for complete < messages {
+		header, payload, err := next(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header&0x0f == WEBSOCKET_OPCODE_TEXT {
+			if !fin || string(payload) != "urgent" {
+				t.Fatalf("urgent message interleaved with a fragmented one")
+			}
+			return
+		}
+		if fin = header&WEBSOCKET_FIN != 0; fin {
+			complete++
+		}
+	}
+	t.Fatalf("urgent message queued behind every regular message")
+}
+
+func TestNothingAfterClose(t *testing.T) {
+	accepted := make(chan *Socket, 1)
+	listener := serve(t, &Config{SendQueue: 1024, CloseTimeout: 200 * time.Millisecond, OpenHandler: func(ws *Socket) { accepted <- ws }})
+	conn, reader, _ := handshake(t, strings.TrimPrefix(listener.URL, "http://"), nil)
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	ws := <-accepted
+
+	// the flusher is stuck behind the unread socket buffers when the close frame jumps the write lock
+	blob := make([]byte, 64<<10)
+	for index := 0; index < 200; index++ {
+		if err := ws.Write(WEBSOCKET_OPCODE_BLOB, blob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go ws.SendClose(WEBSOCKET_ERROR_NORMAL, nil)
+
+	closed := false
+	for {
+		header, _, err := next(reader)
+		if err != nil {
+			break
+		}
+		if closed {
+			t.Fatalf("frame 0x%02x written after the close frame", header)
+		}
+		closed = header&0x0f == WEBSOCKET_OPCODE_CLOSE
+	}
+	if !closed {
+		t.Fatal("no close frame received")
+	}
+}
+
+func TestRSVWithExtension(t *testing.T) {
+	listener := serve(t, &Config{AllowedExtensions: []string{"x-known"}})
+	conn, reader, response := handshake(t, strings.TrimPrefix(listener.URL, "http://"), map[string]string{"Sec-WebSocket-Extensions": "x-known"})
+	if response.Header.Get("Sec-WebSocket-Extensions") != "x-known" {
+		t.Fatalf("extension not negotiated")
+	}
+
+	// a negotiated passthrough extension does not make compressed frames acceptable
+	if _, err := conn.Write([]byte{WEBSOCKET_FIN | 0x40 | WEBSOCKET_OPCODE_BLOB, WEBSOCKET_MASK | 1, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	header, payload, err := next(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != WEBSOCKET_FIN|WEBSOCKET_OPCODE_CLOSE || len(payload) < 2 || binary.BigEndian.Uint16(payload) != WEBSOCKET_ERROR_PROTOCOL {
+		t.Fatalf("expected a %d close frame, got 0x%02x % x", WEBSOCKET_ERROR_PROTOCOL, header, payload)
+	}
+}
+
+func TestStreamText(t *testing.T) {
+	masked := func(header byte, payload ...byte) []byte {
+		return append([]byte{header, WEBSOCKET_MASK | byte(len(payload)), 0, 0, 0, 0}, payload...)
+	}
+
+	// a rune split across frames is valid, and a consumer slower than InactiveTimeout does not time the peer out
+	received := make(chan string, 1)
+	listener := serve(t, &Config{NoProbe: true, ProbeTimeout: int64(time.Second), InactiveTimeout: int64(2 * time.Second),
+		StreamHandler: func(_ *Socket, _ int, reader io.Reader) {
+			first := make([]byte, 1)
+			io.ReadFull(reader, first)
+			time.Sleep(2500 * time.Millisecond)
+			rest, _ := io.ReadAll(reader)
+			received <- string(first) + string(rest)
+		}})
+	conn, reader, _ := handshake(t, strings.TrimPrefix(listener.URL, "http://"), nil)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write(append(masked(WEBSOCKET_OPCODE_TEXT, 'a', 0xc3), masked(WEBSOCKET_FIN, 0xa9, 'b')...))
+	if value := <-received; value != "aéb" {
+		t.Fatalf("unexpected streamed text %q", value)
+	}
+	conn.Write(masked(WEBSOCKET_FIN|WEBSOCKET_OPCODE_PING, 'p'))
+	if header, _, err := next(reader); err != nil || header != WEBSOCKET_FIN|WEBSOCKET_OPCODE_PONG {
+		t.Fatalf("socket did not survive the slow consumer: 0x%02x %v", header, err)
+	}
+
+	for _, payload := range [][]byte{{'a', 0xc3, 0x28}, {'a', 0xc3}} {
+		listener := serve(t, &Config{StreamHandler: func(_ *Socket, _ int, reader io.Reader) {
+			io.Copy(io.Discard, reader)
+		}})
+		conn, reader, _ := handshake(t, strings.TrimPrefix(listener.URL, "http://"), nil)
+		conn.Write(masked(WEBSOCKET_FIN|WEBSOCKET_OPCODE_TEXT, payload...))
+		header, body, err := next(reader)
+		if err != nil || header != WEBSOCKET_FIN|WEBSOCKET_OPCODE_CLOSE || len(body) < 2 || binary.BigEndian.Uint16(body) != WEBSOCKET_ERROR_INVALID {
+			t.Fatalf("expected a %d close frame for % x, got 0x%02x % x %v", WEBSOCKET_ERROR_INVALID, payload, header, body, err)
+		}
+	}
+}
+
+func TestHandshakeNonce(t *testing.T) {
+	previous := keygen
+	defer func() { keygen = previous }()
+	keygen = func() []byte {
+		return []byte("the sample nonce")
+	}
+
+	// RFC 6455 section 1.3 example
+	for accept, success := range map[string]bool{"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=": true, "dGhlIHNhbXBsZSBub25jZQ==": false} {
+		keys := make(chan string, 1)
+		listener := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+			keys <- request.Header.Get("Sec-WebSocket-Key")
+			conn, _, err := response.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: "+accept+"\r\n\r\n")
+		}))
+		ws, err := Dial("ws"+strings.TrimPrefix(listener.URL, "http"), "", nil)
+		listener.Close()
+		if key := <-keys; key != "dGhlIHNhbXBsZSBub25jZQ==" {
+			t.Fatalf("nonce not taken from the hook: %q", key)
+		}
+		if (err == nil) != success {
+			t.Fatalf("unexpected dial result with accept %q: %v", accept, err)
+		}
+		if ws != nil {
+			ws.Close(0)
+		}
+	}
+}
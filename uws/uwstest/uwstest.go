@@ -0,0 +1,89 @@
+package uwstest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyke369/golang-support/uws"
+)
+
+type Server struct {
+	*httptest.Server
+	Endpoint string
+	server   *uws.Server
+	sockets  map[string]*uws.Socket
+	waiters  map[string]chan *uws.Socket
+	sync.Mutex
+}
+
+// server sockets are keyed by their remote address, which is the local address of the matching client
+func NewServer(config *uws.Config) (*Server, string) {
+	s := &Server{server: uws.NewServer(config), sockets: map[string]*uws.Socket{}, waiters: map[string]chan *uws.Socket{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if handled, ws := s.server.Handle(response, request); !handled {
+			response.WriteHeader(http.StatusBadRequest)
+		} else if ws != nil {
+			key := ws.RemoteAddr().String()
+			s.Lock()
+			if waiter := s.waiters[key]; waiter != nil {
+				delete(s.waiters, key)
+				waiter <- ws
+			} else {
+				s.sockets[key] = ws
+			}
+			s.Unlock()
+		}
+	}))
+	s.Endpoint = "ws" + strings.TrimPrefix(s.Server.URL, "http")
+	return s, s.Endpoint
+}
+
+func (s *Server) Dial(config *uws.Config) (client, server *uws.Socket, err error) {
+	if client, err = uws.Dial(s.Endpoint, "", config); err != nil {
+		return nil, nil, err
+	}
+	key, waiter := client.LocalAddr().String(), make(chan *uws.Socket, 1)
+	s.Lock()
+	if server = s.sockets[key]; server != nil {
+		delete(s.sockets, key)
+		s.Unlock()
+		return client, server, nil
+	}
+	s.waiters[key] = waiter
+	s.Unlock()
+	select {
+	case server = <-waiter:
+		return client, server, nil
+	case <-time.After(5 * time.Second):
+		s.Lock()
+		delete(s.waiters, key)
+		s.Unlock()
+		client.Close(0)
+		return nil, nil, errors.New(`uwstest: server socket not accepted`)
+	}
+}
+
+func (s *Server) Count() int {
+	return s.server.Count()
+}
+
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	s.server.Shutdown(ctx)
+	cancel()
+	s.Server.Close()
+}
+
+func Dial(config *uws.Config) (client, server *uws.Socket, closer func(), err error) {
+	s, _ := NewServer(config)
+	if client, server, err = s.Dial(nil); err != nil {
+		s.Close()
+		return nil, nil, nil, err
+	}
+	return client, server, s.Close, nil
+}
@@ -0,0 +1,46 @@
+package uwstest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pyke369/golang-support/uws"
+)
+
+func TestConcurrentDial(t *testing.T) {
+	server, _ := NewServer(&uws.Config{ReadQueue: 4})
+	defer server.Close()
+
+	var group sync.WaitGroup
+
+	failures := make(chan string, 100)
+	for index := 0; index < 100; index++ {
+		group.Add(1)
+		go func(index int) {
+			defer group.Done()
+			client, peer, err := server.Dial(nil)
+			if err != nil {
+				failures <- err.Error()
+				return
+			}
+			defer client.Close(0)
+			if err := client.Write(uws.WEBSOCKET_OPCODE_TEXT, []byte(strconv.Itoa(index))); err != nil {
+				failures <- err.Error()
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, data, err := peer.ReadMessage(ctx); err != nil || string(data) != strconv.Itoa(index) {
+				failures <- "client " + strconv.Itoa(index) + " paired with the wrong server socket"
+			}
+		}(index)
+	}
+	group.Wait()
+	close(failures)
+	for failure := range failures {
+		t.Fatal(failure)
+	}
+}